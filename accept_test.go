@@ -0,0 +1,129 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// errListener fails with the queued errors before accepting from the
+// embedded listener.
+type errListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptError(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	pl := &Listener{Listener: &errListener{errs: []error{emfile, net.ErrClosed}}}
+
+	_, err := pl.Accept()
+	var aerr *AcceptError
+	if !errors.As(err, &aerr) {
+		t.Fatalf("err: %v", err)
+	}
+	if !aerr.Temporary() || aerr.Timeout() {
+		t.Fatalf("bad: %v", aerr)
+	}
+	if !errors.Is(err, syscall.EMFILE) {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, err = pl.Accept()
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("err: %v", err)
+	}
+	if neterr, ok := err.(net.Error); !ok || neterr.Temporary() {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAcceptError_Retry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	pl := &Listener{
+		Listener:             &errListener{Listener: l, errs: []error{emfile, emfile, emfile}},
+		RetryTemporaryAccept: true,
+	}
+	defer pl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Close()
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+}
+
+func TestListener_Swap(t *testing.T) {
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l1, ProxyHeaderTimeout: time.Second}
+	defer pl.Close()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := pl.Accept()
+		accepted <- result{conn, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if old := pl.Swap(l2); old != l1 {
+		t.Fatalf("bad: %v", old)
+	}
+	if pl.Addr() != l2.Addr() {
+		t.Fatalf("bad: %v", pl.Addr())
+	}
+
+	// Closing the old listener moves the waiting Accept to the new one
+	l1.Close()
+	client, err := net.Dial("tcp", l2.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+
+	res := <-accepted
+	if res.err != nil {
+		t.Fatalf("err: %v", res.err)
+	}
+	defer res.conn.Close()
+	if addr := res.conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+package proxyproto
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+// socket activation.
+const listenFdsStart = 3
+
+// ListenersFromActivation returns the listeners passed to the process
+// by systemd socket activation, each wrapped in a proxyproto Listener.
+// The returned listeners may be further configured before use. If the
+// process was not socket activated, nil is returned.
+//
+// The LISTEN_* environment variables are unset so that they are not
+// inherited by child processes.
+func ListenersFromActivation() ([]*Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+
+	listeners := make([]*Listener, 0, nfds)
+	for fd := listenFdsStart; fd < listenFdsStart+nfds; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, pl := range listeners {
+				pl.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, &Listener{Listener: l})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package proxyproto
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestListenersFromActivation_NotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+
+	listeners, err := ListenersFromActivation()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if listeners != nil {
+		t.Fatalf("bad: %v", listeners)
+	}
+}
+
+func TestListenersFromActivation_OtherPid(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+
+	listeners, err := ListenersFromActivation()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if listeners != nil {
+		t.Fatalf("bad: %v", listeners)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatalf("LISTEN_FDS not unset")
+	}
+}
@@ -0,0 +1,116 @@
+package proxyproto
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// AdaptiveTimeout chooses header timeouts from the time recent headers
+// took to arrive, so that ProxyHeaderTimeout does not need tuning for
+// each region or load balancer. The timeout is the 99th percentile of
+// the last Window durations multiplied by Multiplier, bounded by Min and
+// Max. It is safe for concurrent use and may be shared by listeners.
+type AdaptiveTimeout struct {
+	// Multiplier is applied to the percentile. Defaults to 3.
+	Multiplier float64
+
+	// Min and Max bound the timeout. Max is also used until MinSamples
+	// headers have been observed, or ProxyHeaderTimeout if Max is zero.
+	Min time.Duration
+	Max time.Duration
+
+	// Window is the number of recent durations kept. Defaults to 1000.
+	Window int
+
+	// MinSamples is the number of durations observed before adapting.
+	// Defaults to 100, or Window if smaller.
+	MinSamples int
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	stale   int
+	p99     time.Duration
+}
+
+// adaptiveRecompute is the number of observations between computations
+// of the percentile, which sorts the window.
+const adaptiveRecompute = 32
+
+// Observe records the time it took for a header to arrive. Listeners
+// call it for each header read.
+func (a *AdaptiveTimeout) Observe(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if window := a.window(); len(a.samples) < window {
+		a.samples = append(a.samples, d)
+	} else {
+		a.samples[a.next] = d
+		a.next = (a.next + 1) % window
+	}
+	a.stale++
+}
+
+// P99 returns the 99th percentile of the observed durations, or zero if
+// there are fewer than MinSamples.
+func (a *AdaptiveTimeout) P99() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.percentile()
+}
+
+// Timeout returns the header timeout to use, and false if there are not
+// enough samples yet and Max is zero.
+func (a *AdaptiveTimeout) Timeout() (time.Duration, bool) {
+	p99 := a.P99()
+	if p99 == 0 {
+		return a.Max, a.Max > 0
+	}
+
+	mult := a.Multiplier
+	if mult <= 0 {
+		mult = 3
+	}
+	d := time.Duration(float64(p99) * mult)
+	if d < a.Min {
+		d = a.Min
+	}
+	if a.Max > 0 && d > a.Max {
+		d = a.Max
+	}
+	return d, true
+}
+
+// percentile recomputes the percentile if enough samples were observed
+// since the last time. The lock must be held.
+func (a *AdaptiveTimeout) percentile() time.Duration {
+	minSamples := a.MinSamples
+	if minSamples <= 0 {
+		minSamples = 100
+	}
+	if window := a.window(); minSamples > window {
+		minSamples = window
+	}
+	if len(a.samples) < minSamples {
+		return 0
+	}
+	if a.p99 == 0 || a.stale >= adaptiveRecompute {
+		sorted := append([]time.Duration(nil), a.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		a.p99 = sorted[(len(sorted)-1)*99/100]
+		if a.p99 == 0 {
+			// Keep a zero percentile distinct from too few samples
+			a.p99 = 1
+		}
+		a.stale = 0
+	}
+	return a.p99
+}
+
+func (a *AdaptiveTimeout) window() int {
+	if a.Window <= 0 {
+		return 1000
+	}
+	return a.Window
+}
@@ -0,0 +1,66 @@
+package proxyproto
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTimeout(t *testing.T) {
+	a := &AdaptiveTimeout{Min: 50 * time.Millisecond, Max: time.Second, Window: 200}
+
+	// Max is used until there are enough samples
+	if d, ok := a.Timeout(); !ok || d != time.Second {
+		t.Fatalf("bad: %v %v", d, ok)
+	}
+
+	for i := 0; i < 200; i++ {
+		a.Observe(10 * time.Millisecond)
+	}
+	if p99 := a.P99(); p99 != 10*time.Millisecond {
+		t.Fatalf("bad: %v", p99)
+	}
+	if d, _ := a.Timeout(); d != 50*time.Millisecond {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Slow arrivals raise the timeout up to Max
+	for i := 0; i < 200; i++ {
+		a.Observe(100 * time.Millisecond)
+	}
+	if d, _ := a.Timeout(); d != 300*time.Millisecond {
+		t.Fatalf("bad: %v", d)
+	}
+	for i := 0; i < 200; i++ {
+		a.Observe(time.Second)
+	}
+	if d, _ := a.Timeout(); d != time.Second {
+		t.Fatalf("bad: %v", d)
+	}
+
+	if d, ok := (&AdaptiveTimeout{}).Timeout(); ok {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestWrap_AdaptiveTimeout(t *testing.T) {
+	a := &AdaptiveTimeout{MinSamples: 1}
+	input := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	conn := Wrap(&bufConn{r: bytes.NewReader([]byte(input))}, WithAdaptiveTimeout(a))
+	if conn.ProxyHeader() == nil {
+		t.Fatalf("expected header")
+	}
+	if a.P99() == 0 {
+		t.Fatalf("header duration not observed")
+	}
+
+	// Connections without a header are not observed
+	a = &AdaptiveTimeout{MinSamples: 1}
+	conn = Wrap(&bufConn{r: bytes.NewReader([]byte("ping"))}, WithAdaptiveTimeout(a))
+	if conn.ProxyHeader() != nil {
+		t.Fatalf("unexpected header")
+	}
+	if p99 := a.P99(); p99 != 0 {
+		t.Fatalf("bad: %v", p99)
+	}
+}
@@ -0,0 +1,112 @@
+package proxyproto
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// CacheStats is a snapshot of the SourceCheck decision cache statistics.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+}
+
+// decisionCache is an LRU cache of SourceCheck decisions keyed by the
+// upstream IP address.
+type decisionCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+	stats CacheStats
+	now   func() time.Time
+}
+
+type decisionEntry struct {
+	key     string
+	allowed bool
+	err     error
+	expires time.Time
+}
+
+func newDecisionCache(size int, ttl time.Duration) *decisionCache {
+	return &decisionCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+		now:   time.Now,
+	}
+}
+
+// check returns the cached decision for addr, invoking the source
+// checker on a miss. Only decisions, including ErrInvalidUpstream,
+// are cached; other errors are not.
+func (c *decisionCache) check(addr net.Addr, checker SourceChecker) (bool, error) {
+	key := addrKey(addr)
+
+	c.mu.Lock()
+	if elem, ok := c.items[key]; ok {
+		ent := elem.Value.(*decisionEntry)
+		if c.ttl == 0 || c.now().Before(ent.expires) {
+			c.ll.MoveToFront(elem)
+			c.stats.Hits++
+			c.mu.Unlock()
+			return ent.allowed, ent.err
+		}
+		c.ll.Remove(elem)
+		delete(c.items, key)
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	allowed, err := checker(addr)
+	if err != nil && err != ErrInvalidUpstream {
+		return allowed, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ent := &decisionEntry{key: key, allowed: allowed, err: err}
+	if c.ttl != 0 {
+		ent.expires = c.now().Add(c.ttl)
+	}
+	if elem, ok := c.items[key]; ok {
+		elem.Value = ent
+		c.ll.MoveToFront(elem)
+		return allowed, err
+	}
+	c.items[key] = c.ll.PushFront(ent)
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*decisionEntry).key)
+		c.stats.Evictions++
+	}
+	return allowed, err
+}
+
+// Stats returns a snapshot of the cache statistics.
+func (c *decisionCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.ll.Len()
+	return stats
+}
+
+// addrKey returns the IP of addr, ignoring the port.
+func addrKey(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,73 @@
+package proxyproto
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDecisionCache(t *testing.T) {
+	var calls int
+	checker := func(addr net.Addr) (bool, error) {
+		calls++
+		if addr.(*net.TCPAddr).IP.String() == badAddr {
+			return false, ErrInvalidUpstream
+		}
+		return true, nil
+	}
+
+	c := newDecisionCache(2, 0)
+	good := &net.TCPAddr{IP: net.ParseIP(goodAddr), Port: 1000}
+	bad := &net.TCPAddr{IP: net.ParseIP(badAddr), Port: 1000}
+
+	for port := 1000; port < 1003; port++ {
+		good.Port = port
+		if allowed, err := c.check(good, checker); !allowed || err != nil {
+			t.Fatalf("bad: %v %v", allowed, err)
+		}
+	}
+	if _, err := c.check(bad, checker); err != ErrInvalidUpstream {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := c.check(bad, checker); err != ErrInvalidUpstream {
+		t.Fatalf("err: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("bad: %d", calls)
+	}
+
+	// Evict the good address
+	third := &net.TCPAddr{IP: net.ParseIP("127.0.0.3")}
+	c.check(third, checker)
+	c.check(good, checker)
+	if calls != 4 {
+		t.Fatalf("bad: %d", calls)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 3 || stats.Misses != 4 || stats.Evictions != 2 || stats.Size != 2 {
+		t.Fatalf("bad: %+v", stats)
+	}
+}
+
+func TestDecisionCache_TTL(t *testing.T) {
+	var calls int
+	checker := func(addr net.Addr) (bool, error) {
+		calls++
+		return true, nil
+	}
+
+	c := newDecisionCache(10, 10*time.Millisecond)
+	addr := &net.TCPAddr{IP: net.ParseIP(goodAddr)}
+	c.check(addr, checker)
+	c.check(addr, checker)
+	if calls != 1 {
+		t.Fatalf("bad: %d", calls)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	c.check(addr, checker)
+	if calls != 2 {
+		t.Fatalf("bad: %d", calls)
+	}
+}
@@ -0,0 +1,18 @@
+package proxyproto
+
+// ConnCallbacks are invoked at points in the lifecycle of connections
+// accepted by a Listener, so applications can maintain connection
+// registries, audit logs or per-client metrics in one place. Any of
+// the callbacks may be nil.
+type ConnCallbacks struct {
+	// OnAccept is called when a connection is returned by Accept,
+	// before its header has been read.
+	OnAccept func(*Conn)
+
+	// OnHeader is called once the header of a connection has been
+	// read. The header is nil if the connection did not send one.
+	OnHeader func(*Conn, *Header)
+
+	// OnClose is called the first time the connection is closed.
+	OnClose func(*Conn)
+}
@@ -0,0 +1,53 @@
+package proxyproto
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConnCallbacks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var events []string
+	pl := &Listener{
+		Listener: l,
+		ConnCallbacks: ConnCallbacks{
+			OnAccept: func(*Conn) { events = append(events, "accept") },
+			OnHeader: func(c *Conn, h *Header) {
+				events = append(events, "header "+h.SrcAddr.String())
+			},
+			OnClose: func(*Conn) { events = append(events, "close") },
+		},
+	}
+	defer pl.Close()
+
+	client, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	conn.Close()
+
+	expected := []string{"accept", "header 10.1.1.1:1000", "close"}
+	if len(events) != len(expected) {
+		t.Fatalf("bad: %v", events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("bad: %v", events)
+		}
+	}
+}
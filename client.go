@@ -0,0 +1,80 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ClientConn is a connection to a backend that writes a header before
+// any data sent on it, in the same write as the first data when
+// possible. Once the header is sent, ReadFrom delegates to the
+// underlying connection, so io.Copy into a ClientConn still uses
+// sendfile or splice where the platform supports them.
+type ClientConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	header []byte
+	sent   atomic.Bool
+}
+
+// NewClientConn returns a ClientConn writing the header h on conn.
+func NewClientConn(conn net.Conn, h *Header) (*ClientConn, error) {
+	buf, err := h.Format()
+	if err != nil {
+		return nil, err
+	}
+	return &ClientConn{Conn: conn, header: buf}, nil
+}
+
+// Write writes b, prefixed with the header if it was not sent yet.
+func (c *ClientConn) Write(b []byte) (int, error) {
+	if c.sent.Load() {
+		return c.Conn.Write(b)
+	}
+
+	c.mu.Lock()
+	if c.sent.Load() {
+		c.mu.Unlock()
+		return c.Conn.Write(b)
+	}
+	defer c.mu.Unlock()
+
+	hlen := len(c.header)
+	buf := make([]byte, 0, hlen+len(b))
+	buf = append(append(buf, c.header...), b...)
+	n, err := c.Conn.Write(buf)
+	if n < hlen {
+		c.header = c.header[n:]
+		return 0, err
+	}
+	c.header = nil
+	c.sent.Store(true)
+	return n - hlen, err
+}
+
+// Flush sends the header if it was not sent yet, for protocols where
+// the backend speaks first.
+func (c *ClientConn) Flush() error {
+	_, err := c.Write(nil)
+	return err
+}
+
+// ReadFrom sends the header, then copies r to the underlying connection
+// using its ReadFrom if it has one.
+func (c *ClientConn) ReadFrom(r io.Reader) (int64, error) {
+	if err := c.Flush(); err != nil {
+		return 0, err
+	}
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(c.Conn, r)
+}
+
+// NetConn returns the underlying connection.
+func (c *ClientConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,183 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordConn records what is written to it and whether ReadFrom is
+// used.
+type recordConn struct {
+	buf       bytes.Buffer
+	writes    int
+	readFroms int
+	net.Conn  // nil; crash on any unexpected use
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.buf.Write(p)
+}
+
+func (c *recordConn) ReadFrom(r io.Reader) (int64, error) {
+	c.readFroms++
+	return c.buf.ReadFrom(r)
+}
+
+func TestClientConn_Write(t *testing.T) {
+	inner := &recordConn{}
+	h := NewHeaderV1(netip.MustParseAddrPort("10.1.1.1:1000"), netip.MustParseAddrPort("20.2.2.2:2000"))
+	conn, err := NewClientConn(inner, h)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	n, err := conn.Write([]byte("ping"))
+	if err != nil || n != 4 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	conn.Write([]byte("pong"))
+
+	expected := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\npingpong"
+	if inner.buf.String() != expected {
+		t.Fatalf("bad: %q", inner.buf.String())
+	}
+
+	// The header goes out with the first data
+	if inner.writes != 2 {
+		t.Fatalf("bad: %d", inner.writes)
+	}
+}
+
+func TestClientConn_ReadFrom(t *testing.T) {
+	inner := &recordConn{}
+	h := NewHeaderV1(netip.MustParseAddrPort("10.1.1.1:1000"), netip.MustParseAddrPort("20.2.2.2:2000"))
+	conn, err := NewClientConn(inner, h)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := io.Copy(conn, struct{ io.Reader }{strings.NewReader("ping")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"
+	if inner.buf.String() != expected {
+		t.Fatalf("bad: %q", inner.buf.String())
+	}
+	if inner.readFroms != 1 {
+		t.Fatalf("ReadFrom not delegated")
+	}
+}
+
+func TestDialer_CoalesceHeader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+	defer pl.Close()
+
+	src := netip.MustParseAddrPort("10.1.1.1:1000")
+	dst := netip.MustParseAddrPort("20.2.2.2:2000")
+	d := &Dialer{
+		HeaderSource:   func(net.Conn) *Header { return NewHeaderV2(src, dst) },
+		CoalesceHeader: true,
+	}
+	client, err := d.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	if _, ok := client.(*ClientConn); !ok {
+		t.Fatalf("bad: %T", client)
+	}
+	client.Write([]byte("ping"))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "ping" {
+		t.Fatalf("bad: %q", recv)
+	}
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+// benchmarkClientCopy copies a file to a loopback TCP connection
+// through a ClientConn, optionally hiding its ReadFrom method.
+func benchmarkClientCopy(b *testing.B, hideReadFrom bool) {
+	data := make([]byte, 4<<20)
+	path := filepath.Join(b.TempDir(), "data")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		b.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer raw.Close()
+	h := NewHeaderV2(netip.MustParseAddrPort("10.1.1.1:1000"), netip.MustParseAddrPort("20.2.2.2:2000"))
+	conn, err := NewClientConn(raw, h)
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	var w io.Writer = conn
+	if hideReadFrom {
+		w = struct{ io.Writer }{conn}
+	}
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := os.Open(path)
+		if err != nil {
+			b.Fatalf("err: %v", err)
+		}
+		if _, err := io.Copy(w, f); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+		f.Close()
+	}
+}
+
+func BenchmarkClientConn_ReadFrom(b *testing.B) {
+	benchmarkClientCopy(b, false)
+}
+
+func BenchmarkClientConn_Write(b *testing.B) {
+	benchmarkClientCopy(b, true)
+}
@@ -0,0 +1,67 @@
+package proxyproto
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of listeners and connections, which may
+// be replaced to test timeouts without waiting for them.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock. *time.Timer implements it.
+type Timer interface {
+	Stop() bool
+}
+
+// aLongTimeAgo is a read deadline in the past, making reads fail with a
+// timeout right away.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// now returns the current time of the connection's clock.
+func (p *Conn) now() time.Time {
+	if p.clock == nil {
+		return time.Now()
+	}
+	return p.clock.Now()
+}
+
+// afterFunc calls f after d on the connection's clock.
+func (p *Conn) afterFunc(d time.Duration, f func()) Timer {
+	if p.clock == nil {
+		return time.AfterFunc(d, f)
+	}
+	return p.clock.AfterFunc(d, f)
+}
+
+// setHeaderDeadline makes reading the header fail with a timeout once
+// ProxyHeaderTimeout has elapsed, and returns a function to call when it
+// is read. With the system clock, this is a read deadline. Other clocks
+// make the read time out by moving the deadline to the past when their
+// timer fires, as deadlines cannot follow them.
+func (p *Conn) setHeaderDeadline() (clear func()) {
+	if p.clock == nil {
+		p.conn.SetReadDeadline(time.Now().Add(p.proxyHeaderTimeout))
+		return func() { p.conn.SetReadDeadline(time.Time{}) }
+	}
+
+	var mu sync.Mutex
+	var done bool
+	t := p.clock.AfterFunc(p.proxyHeaderTimeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !done {
+			p.conn.SetReadDeadline(aLongTimeAgo)
+		}
+	})
+	return func() {
+		mu.Lock()
+		done = true
+		mu.Unlock()
+		t.Stop()
+		p.conn.SetReadDeadline(time.Time{})
+	}
+}
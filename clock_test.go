@@ -0,0 +1,63 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFakeClock_HeaderTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := Wrap(server, WithProxyHeaderTimeout(time.Minute), WithClock(clock))
+	defer conn.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 4))
+		errCh <- err
+	}()
+
+	// Half a header, then nothing
+	client.Write([]byte("PROXY TCP4 "))
+	clock.BlockUntil(1)
+	clock.Advance(59 * time.Second)
+	select {
+	case err := <-errCh:
+		t.Fatalf("early timeout: %v", err)
+	default:
+	}
+
+	clock.Advance(time.Second)
+	var timeoutErr *HeaderTimeoutError
+	if err := <-errCh; !errors.As(err, &timeoutErr) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestFakeClock_HeaderInTime(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := Wrap(server, WithProxyHeaderTimeout(time.Minute), WithClock(clock))
+	defer conn.Close()
+
+	go client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The timer is stopped and later reads are not affected
+	clock.Advance(time.Hour)
+	go client.Write([]byte("pong"))
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := conn.HeaderReadDuration(); d != 0 {
+		t.Fatalf("bad: %v", d)
+	}
+}
@@ -0,0 +1,57 @@
+package proxyproto
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// connContextKey is the context key for the *Conn of a request.
+type connContextKey struct{}
+
+// ConnContext stores the *Conn underlying c in ctx, so the header can
+// later be retrieved with FromContext. It has the signature of
+// http.Server's ConnContext field and unwraps *tls.Conn. Other
+// connections leave ctx unchanged.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	if pConn, ok := c.(*Conn); ok {
+		return context.WithValue(ctx, connContextKey{}, pConn)
+	}
+	return ctx
+}
+
+// FromContext returns the header of the connection stored in ctx by
+// ConnContext. It returns false if there is no connection in ctx, or
+// it did not send a header or SourceCheck did not trust it, as with
+// Conn.ProxyHeader.
+func FromContext(ctx context.Context) (*Header, bool) {
+	pConn, ok := ctx.Value(connContextKey{}).(*Conn)
+	if !ok {
+		return nil, false
+	}
+	h := pConn.ProxyHeader()
+	return h, h != nil
+}
+
+// ConnFromContext returns the *Conn stored in ctx by ConnContext or
+// Conn.Context.
+func ConnFromContext(ctx context.Context) (*Conn, bool) {
+	pConn, ok := ctx.Value(connContextKey{}).(*Conn)
+	return pConn, ok
+}
+
+// Context returns a context carrying the connection, from which
+// FromContext returns its header and ConnFromContext the connection
+// itself. It is derived from the Listener's BaseContext, or from
+// context.Background if not set. The header is read first if needed.
+func (p *Conn) Context() context.Context {
+	p.checkPrefixOnce()
+	base := p.baseCtx
+	if base == nil {
+		base = context.Background()
+	}
+	return context.WithValue(base, connContextKey{}, p)
+}
@@ -0,0 +1,78 @@
+package proxyproto
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConnContext_HTTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h, ok := FromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			io.WriteString(w, h.SrcAddr.String()+" "+h.DstAddr.String())
+		}),
+		ConnContext: ConnContext,
+	}
+	go srv.Serve(&Listener{Listener: l})
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.HasSuffix(string(resp), "10.1.1.1:1000 20.2.2.2:2000") {
+		t.Fatalf("bad: %s", resp)
+	}
+}
+
+func TestFromContext_Missing(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Fatalf("expected no header")
+	}
+	ctx := ConnContext(context.Background(), &testConn{})
+	if _, ok := FromContext(ctx); ok {
+		t.Fatalf("expected no header")
+	}
+}
+
+func TestConn_Context(t *testing.T) {
+	type key struct{}
+	base := context.WithValue(context.Background(), key{}, "base")
+
+	input := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	conn := Wrap(&bufConn{r: bytes.NewReader([]byte(input))}, WithBaseContext(base))
+	ctx := conn.Context()
+
+	if ctx.Value(key{}) != "base" {
+		t.Fatalf("bad: %v", ctx.Value(key{}))
+	}
+	h, ok := FromContext(ctx)
+	if !ok || h.SrcAddr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", h)
+	}
+	if c, ok := ConnFromContext(ctx); !ok || c != conn {
+		t.Fatalf("bad: %v", c)
+	}
+}
@@ -0,0 +1,170 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Dialer connects to backends that expect the proxy protocol, writing a
+// header as soon as the connection is established.
+type Dialer struct {
+	// Dialer is used to establish the connections.
+	Dialer net.Dialer
+
+	// HeaderSource returns the header to write on a new connection. If
+	// it is nil or returns nil, a header without addresses is written,
+	// LOCAL for version 2 and UNKNOWN for version 1.
+	HeaderSource func(conn net.Conn) *Header
+
+	// HeaderTransform, if set, is applied to the headers returned by
+	// HeaderSource before they are written, for example to anonymize
+	// client addresses with MaskAddrs. It must not modify its argument,
+	// which may be the header of another connection, but return a copy.
+	HeaderTransform func(*Header) *Header
+
+	// Version overrides the version of the headers if non-zero.
+	Version int
+
+	// CoalesceHeader delays the header until the first write, sending
+	// both in one segment. The returned connections are *ClientConn.
+	CoalesceHeader bool
+
+	// FallbackToV2 writes version 2 headers in place of version 1
+	// headers that cannot be represented in version 1, such as UDP
+	// headers or those with zoned IPv6 addresses.
+	FallbackToV2 bool
+
+	// TLVs are appended to every version 2 header written, LOCAL ones
+	// included, to tag traffic with static information such as a
+	// cluster or region.
+	TLVs []TLV
+}
+
+// Dial connects to the address on the named network and writes the
+// header.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using the
+// provided context and writes the header. The context's deadline also
+// applies to writing the header.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.CoalesceHeader {
+		cc, err := NewClientConn(conn, d.header(conn))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return cc, nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	if err := WriteHeader(conn, d.header(conn), 0); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// WriteHeader writes h on conn in the given version, or in the version
+// of h if zero. It is what Dialer does on new connections, for
+// connections established otherwise, such as internal hops sending the
+// header inside TLS once the handshake is done.
+func WriteHeader(conn net.Conn, h *Header, version int) error {
+	e, err := h.Encode(version)
+	if err != nil {
+		return err
+	}
+	_, err = e.WriteTo(conn)
+	return err
+}
+
+// header returns the header to write on conn.
+func (d *Dialer) header(conn net.Conn) *Header {
+	h := d.baseHeader(conn)
+	if len(d.TLVs) > 0 && h.Version == 2 {
+		hc := h.clone()
+		hc.TLVs = append(append(make([]TLV, 0, len(h.TLVs)+len(d.TLVs)), h.TLVs...), d.TLVs...)
+		h = hc
+	}
+	return h
+}
+
+// baseHeader returns the header to write on conn, before the static
+// TLVs are added.
+func (d *Dialer) baseHeader(conn net.Conn) *Header {
+	var h *Header
+	if d.HeaderSource != nil {
+		h = d.HeaderSource(conn)
+	}
+	if h != nil && d.HeaderTransform != nil {
+		h = d.HeaderTransform(h)
+	}
+	version := d.Version
+	if h == nil {
+		if version == 1 {
+			return &Header{Version: 1, Command: "PROXY", Protocol: "UNKNOWN"}
+		}
+		return &Header{Version: 2, Command: "LOCAL", Protocol: "UNSPEC"}
+	}
+	if version != 0 && version != h.Version {
+		hc := h.clone()
+		hc.Version = version
+		h = hc
+	}
+	if d.FallbackToV2 && h.Version == 1 {
+		if _, err := h.Format(); errors.Is(err, ErrNotRepresentableV1) {
+			hc := h.clone()
+			hc.Version = 2
+			h = hc
+		}
+	}
+	return h
+}
+
+// MaskAddrs returns a HeaderTransform truncating the source IP address
+// of headers, the client's, to its first v4Bits bits for IPv4 and
+// v6Bits bits for IPv6, such as 24 and 48, for deployments that must not
+// pass full client addresses downstream.
+func MaskAddrs(v4Bits, v6Bits int) func(*Header) *Header {
+	return func(h *Header) *Header {
+		ap, ok := addrPort(h.SrcAddr)
+		if !ok {
+			return h
+		}
+		addr := ap.Addr()
+		bits := v6Bits
+		if addr.Is4In6() {
+			bits = v4Bits + 96
+		} else if addr.Is4() {
+			bits = v4Bits
+		}
+		if bits < 0 {
+			bits = 0
+		} else if bits > addr.BitLen() {
+			bits = addr.BitLen()
+		}
+		prefix, _ := addr.Prefix(bits)
+		masked := netip.AddrPortFrom(prefix.Addr(), ap.Port())
+
+		hc := h.clone()
+		if _, ok := h.SrcAddr.(*net.UDPAddr); ok {
+			hc.SrcAddr = net.UDPAddrFromAddrPort(masked)
+		} else {
+			hc.SrcAddr = net.TCPAddrFromAddrPort(masked)
+		}
+		return hc
+	}
+}
@@ -0,0 +1,193 @@
+package proxyproto
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l, UnknownOK: true}
+	defer pl.Close()
+
+	src := netip.MustParseAddrPort("10.1.1.1:1000")
+	dst := netip.MustParseAddrPort("20.2.2.2:2000")
+	dialers := []*Dialer{
+		{HeaderSource: func(net.Conn) *Header { return NewHeaderV2(src, dst) }},
+		{HeaderSource: func(net.Conn) *Header { return NewHeaderV2(src, dst) }, Version: 1},
+		{Version: 1},
+		{},
+	}
+	expected := []string{"10.1.1.1:1000", "10.1.1.1:1000", "", ""}
+
+	for i, d := range dialers {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		client, err := d.DialContext(ctx, "tcp", pl.Addr().String())
+		cancel()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer client.Close()
+		client.Write([]byte("ping"))
+
+		conn, err := pl.AcceptProxy()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+
+		recv := make([]byte, 4)
+		if _, err := conn.Read(recv); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(recv) != "ping" {
+			t.Fatalf("bad: %v", recv)
+		}
+
+		h := conn.ProxyHeader()
+		if h == nil {
+			t.Fatalf("%d: no header", i)
+		}
+		if expected[i] == "" {
+			if h.SrcAddr != nil {
+				t.Fatalf("%d: bad: %v", i, h.SrcAddr)
+			}
+			continue
+		}
+		if h.SrcAddr.String() != expected[i] {
+			t.Fatalf("%d: bad: %v", i, h.SrcAddr)
+		}
+		if d.Version != 0 && h.Version != d.Version {
+			t.Fatalf("%d: bad: %v", i, h.Version)
+		}
+	}
+}
+
+func TestDialer_FallbackToV2(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.UDPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	udp := &Header{Version: 1, Command: "PROXY", Protocol: "UDP4", SrcAddr: src, DstAddr: dst}
+
+	d := &Dialer{HeaderSource: func(net.Conn) *Header { return udp }, FallbackToV2: true}
+	if h := d.header(nil); h.Version != 2 || h.Protocol != "UDP4" {
+		t.Fatalf("bad: %+v", h)
+	}
+	if udp.Version != 1 {
+		t.Fatalf("bad: %+v", udp)
+	}
+
+	d.FallbackToV2 = false
+	if h := d.header(nil); h.Version != 1 {
+		t.Fatalf("bad: %+v", h)
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	src := netip.MustParseAddrPort("10.1.1.1:1000")
+	dst := netip.MustParseAddrPort("20.2.2.2:2000")
+
+	for _, version := range []int{0, 1, 2} {
+		client, server := net.Pipe()
+		conn := Wrap(server)
+		go func() {
+			WriteHeader(client, NewHeaderV2(src, dst), version)
+			client.Close()
+		}()
+
+		h := conn.ProxyHeader()
+		expected := version
+		if expected == 0 {
+			expected = 2
+		}
+		if h == nil || h.Version != expected || h.SrcAddr.String() != "10.1.1.1:1000" {
+			t.Fatalf("bad: %+v", h)
+		}
+		conn.Close()
+	}
+}
+
+func TestDialer_HeaderTransform(t *testing.T) {
+	dst := netip.MustParseAddrPort("20.2.2.2:2000")
+	cases := []struct {
+		src    string
+		masked string
+	}{
+		{"10.1.1.1:1000", "10.1.1.0:1000"},
+		{"[2001:db8:1:2:3::1]:1000", "[2001:db8:1::]:1000"},
+	}
+
+	for _, c := range cases {
+		orig := NewHeaderV2(netip.MustParseAddrPort(c.src), dst)
+		src := orig.SrcAddr.String()
+		d := &Dialer{
+			HeaderSource:    func(net.Conn) *Header { return orig },
+			HeaderTransform: MaskAddrs(24, 48),
+		}
+		h := d.header(nil)
+		if h.SrcAddr.String() != c.masked || h.DstAddr.String() != "20.2.2.2:2000" {
+			t.Fatalf("bad: %v", h)
+		}
+		if orig.SrcAddr.String() != src {
+			t.Fatalf("bad: %v", orig)
+		}
+	}
+}
+
+func TestDialer_TLVs(t *testing.T) {
+	orig := NewHeaderV2(netip.MustParseAddrPort("10.1.1.1:1000"), netip.MustParseAddrPort("20.2.2.2:2000")).WithALPN("h2")
+	region := TLV{Type: 0xE0, Value: []byte("eu-west-1")}
+	d := &Dialer{
+		HeaderSource: func(net.Conn) *Header { return orig },
+		TLVs:         []TLV{region},
+	}
+
+	h := d.header(nil)
+	if len(h.TLVs) != 2 || h.TLVs[0].Type != TLVTypeALPN || h.TLVs[1].Type != 0xE0 {
+		t.Fatalf("bad: %v", h.TLVs)
+	}
+	if len(orig.TLVs) != 1 {
+		t.Fatalf("bad: %v", orig.TLVs)
+	}
+
+	// LOCAL headers are tagged too, version 1 headers are not
+	d.HeaderSource = nil
+	if h := d.header(nil); h.Command != "LOCAL" || len(h.TLVs) != 1 {
+		t.Fatalf("bad: %v", h)
+	}
+	d.Version = 1
+	if h := d.header(nil); len(h.TLVs) != 0 {
+		t.Fatalf("bad: %v", h)
+	}
+}
+
+func TestDialer_SharedHeader(t *testing.T) {
+	// Headers shared by connections are copied while others encode them
+	var orig *Header
+	d := &Dialer{
+		HeaderSource: func(net.Conn) *Header { return orig },
+		Version:      1,
+	}
+	for i := 0; i < 100; i++ {
+		orig = NewHeaderV2(netip.MustParseAddrPort("10.1.1.1:1000"), netip.MustParseAddrPort("20.2.2.2:2000"))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func(h *Header) {
+			defer wg.Done()
+			if _, err := h.Encode(2); err != nil {
+				t.Errorf("err: %v", err)
+			}
+		}(orig)
+		if _, err := d.header(nil).Encode(0); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		wg.Wait()
+	}
+}
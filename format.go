@@ -0,0 +1,252 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// Format returns the wire representation of the header in its Version.
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1()
+	case 2:
+		return h.formatV2()
+	}
+	return nil, fmt.Errorf("Unsupported version: %d", h.Version)
+}
+
+// EncodedHeader is the wire representation of a header in a given
+// version, computed once by Header.Encode for proxies writing the same
+// header on many connections. It is immutable: later changes to the
+// header, its addresses or its TLVs are not reflected in it.
+type EncodedHeader struct {
+	version int
+	buf     []byte
+}
+
+// Encode returns the wire representation of the header in the given
+// version, or in its Version if zero, to be written on many connections
+// without formatting it again.
+func (h *Header) Encode(version int) (*EncodedHeader, error) {
+	if version == 0 {
+		version = h.Version
+	}
+	hc := h.clone()
+	hc.Version = version
+	buf, err := hc.Format()
+	if err != nil {
+		return nil, err
+	}
+	return &EncodedHeader{version: version, buf: buf}, nil
+}
+
+// Version returns the protocol version of the encoding, 1 or 2.
+func (e *EncodedHeader) Version() int {
+	return e.version
+}
+
+// Bytes returns the encoded header. The bytes are shared and must not
+// be modified.
+func (e *EncodedHeader) Bytes() []byte {
+	return e.buf
+}
+
+// WriteTo writes the encoded header to w.
+func (e *EncodedHeader) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(e.buf)
+	return int64(n), err
+}
+
+// WriteTo writes the wire representation of the header to w.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	buf, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// DowngradeToV1 returns a version 1 copy of the header, for proxies
+// receiving version 2 headers to pass on to backends that only support
+// version 1. LOCAL and UNSPEC headers become UNKNOWN ones, which also
+// tell the backend to use the addresses of the connection. It returns
+// an error wrapping ErrNotRepresentableV1 for headers with TLVs or of
+// other transports than TCP.
+func (h *Header) DowngradeToV1() (*Header, error) {
+	if len(h.TLVs) > 0 {
+		return nil, fmt.Errorf("%w: %d TLVs", ErrNotRepresentableV1, len(h.TLVs))
+	}
+	if h.Command == "LOCAL" || h.Protocol == "UNSPEC" || h.Protocol == "UNKNOWN" {
+		return &Header{Version: 1, Command: "PROXY", Protocol: "UNKNOWN"}, nil
+	}
+
+	v1 := &Header{
+		Version:  1,
+		Command:  h.Command,
+		Protocol: h.Protocol,
+		SrcAddr:  h.SrcAddr,
+		DstAddr:  h.DstAddr,
+	}
+	if _, err := v1.formatV1(); err != nil {
+		return nil, err
+	}
+	return v1, nil
+}
+
+func (h *Header) formatV1() ([]byte, error) {
+	if h.Command != "" && h.Command != "PROXY" {
+		return nil, fmt.Errorf("%w: command %s", ErrNotRepresentableV1, h.Command)
+	}
+	switch h.Protocol {
+	case "UNKNOWN":
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: protocol %s", ErrNotRepresentableV1, h.Protocol)
+	}
+
+	srcIP, srcPort, err := v1Addr(h.Protocol, h.SrcAddr)
+	if err != nil {
+		return nil, err
+	}
+	dstIP, dstPort, err := v1Addr(h.Protocol, h.DstAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	line := "PROXY " + h.Protocol + " " + srcIP + " " + dstIP + " " +
+		strconv.Itoa(srcPort) + " " + strconv.Itoa(dstPort) + "\r\n"
+	return []byte(line), nil
+}
+
+// v1Addr returns the IP address and port of addr in the normalized form
+// expected by strict version 1 parsers: IPv4 addresses in dotted
+// decimal for TCP4, and IPv6 addresses in lowercase, compressed form for
+// TCP6, with IPv4-mapped addresses as "::ffff:a.b.c.d".
+func v1Addr(protocol string, addr net.Addr) (string, int, error) {
+	var zone string
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		zone = a.Zone
+	case *net.UDPAddr:
+		zone = a.Zone
+	}
+	ip, port := addrIPPort(addr)
+	a, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return "", 0, fmt.Errorf("Invalid address for %s: %v", protocol, addr)
+	}
+	if zone != "" {
+		return "", 0, fmt.Errorf("%w: zoned address %v", ErrNotRepresentableV1, addr)
+	}
+	if protocol == "TCP4" {
+		a = a.Unmap()
+		if !a.Is4() {
+			return "", 0, fmt.Errorf("%w: %v for %s", ErrAddressFamilyMismatch, addr, protocol)
+		}
+	} else if !a.Is6() {
+		return "", 0, fmt.Errorf("%w: %v for %s", ErrAddressFamilyMismatch, addr, protocol)
+	}
+	return a.String(), port, nil
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	var cmd byte
+	switch h.Command {
+	case "LOCAL":
+		cmd = 0x0
+	case "PROXY", "":
+		cmd = 0x1
+	default:
+		return nil, fmt.Errorf("Invalid v2 command: %s", h.Command)
+	}
+
+	var fam byte
+	var addrs []byte
+	switch h.Protocol {
+	case "UNSPEC", "UNKNOWN":
+		fam = 0x00
+	case "TCP4", "UDP4", "TCP6", "UDP6":
+		fam = 0x11
+		ipLen := net.IPv4len
+		if h.Protocol[3] == '6' {
+			fam = 0x21
+			ipLen = net.IPv6len
+		}
+		if h.Protocol[:3] == "UDP" {
+			fam++
+		}
+		addrs = make([]byte, 2*ipLen+4)
+		if h.SrcAddr != nil || h.DstAddr != nil {
+			srcIP, srcPort := addrIPPort(h.SrcAddr)
+			dstIP, dstPort := addrIPPort(h.DstAddr)
+			if ipLen == net.IPv4len {
+				srcIP, dstIP = srcIP.To4(), dstIP.To4()
+			} else {
+				srcIP, dstIP = srcIP.To16(), dstIP.To16()
+			}
+			if srcIP == nil || dstIP == nil {
+				return nil, fmt.Errorf("Invalid addresses for %s: %v %v", h.Protocol, h.SrcAddr, h.DstAddr)
+			}
+			copy(addrs, srcIP)
+			copy(addrs[ipLen:], dstIP)
+			binary.BigEndian.PutUint16(addrs[2*ipLen:], uint16(srcPort))
+			binary.BigEndian.PutUint16(addrs[2*ipLen+2:], uint16(dstPort))
+		}
+	case "UNIX_STREAM", "UNIX_DGRAM":
+		fam = 0x31
+		if h.Protocol == "UNIX_DGRAM" {
+			fam = 0x32
+		}
+		addrs = make([]byte, v2AddrLenUnix)
+		if h.SrcAddr != nil {
+			copy(addrs[:108], h.SrcAddr.String())
+		}
+		if h.DstAddr != nil {
+			copy(addrs[108:], h.DstAddr.String())
+		}
+	default:
+		return nil, fmt.Errorf("Unhandled address type: %s", h.Protocol)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(sigV2)
+	buf.WriteByte(0x20 | cmd)
+	buf.WriteByte(fam)
+	buf.Write([]byte{0, 0})
+	buf.Write(addrs)
+	for _, tlv := range h.TLVs {
+		if len(tlv.Value) > 0xFFFF {
+			return nil, fmt.Errorf("TLV %#x too long: %d", tlv.Type, len(tlv.Value))
+		}
+		buf.WriteByte(tlv.Type)
+		buf.Write([]byte{byte(len(tlv.Value) >> 8), byte(len(tlv.Value))})
+		buf.Write(tlv.Value)
+	}
+
+	out := buf.Bytes()
+	length := len(out) - v2HeaderLen
+	if length > 0xFFFF {
+		return nil, fmt.Errorf("Header too long: %d", length)
+	}
+	binary.BigEndian.PutUint16(out[14:16], uint16(length))
+	return out, nil
+}
+
+// addrIPPort returns the IP and port of a TCP or UDP address.
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
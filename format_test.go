@@ -0,0 +1,305 @@
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+// parseBytes parses a header from the start of b.
+func parseBytes(t *testing.T, b []byte) *Header {
+	conn := NewConn(&bufConn{r: bytes.NewReader(append(b, "ping"...))}, 0)
+	conn.unknownOK = true
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "ping" {
+		t.Fatalf("bad: %v", recv)
+	}
+	return conn.proxyHeader()
+}
+
+func TestHeaderFormat_RoundTrip(t *testing.T) {
+	v4src := netip.MustParseAddrPort("10.1.1.1:1000")
+	v4dst := netip.MustParseAddrPort("20.2.2.2:2000")
+	v6src := netip.MustParseAddrPort("[ffff::ffff]:1000")
+	v6dst := netip.MustParseAddrPort("[::1]:2000")
+
+	headers := []*Header{
+		NewHeaderV1(v4src, v4dst),
+		NewHeaderV1(v6src, v6dst),
+		{Version: 1, Command: "PROXY", Protocol: "UNKNOWN"},
+		NewHeaderV2(v4src, v4dst),
+		NewHeaderV2(v6src, v6dst),
+		NewHeaderV2(v4src, v6dst),
+		{Version: 2, Command: "LOCAL", Protocol: "UNSPEC"},
+		{
+			Version:  2,
+			Command:  "PROXY",
+			Protocol: "UNIX_STREAM",
+			SrcAddr:  &net.UnixAddr{Name: "/src.sock", Net: "unix"},
+			DstAddr:  &net.UnixAddr{Name: "/dst.sock", Net: "unix"},
+			TLVs:     []TLV{{Type: 0x01, Value: []byte("h2")}},
+		},
+	}
+
+	for _, h := range headers {
+		buf, err := h.Format()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		parsed := parseBytes(t, buf)
+		if parsed.Version != h.Version || parsed.Protocol != h.Protocol || parsed.Command != h.Command {
+			t.Fatalf("bad: %+v != %+v", parsed, h)
+		}
+		if h.SrcAddr != nil && parsed.SrcAddr.String() != h.SrcAddr.String() {
+			t.Fatalf("bad: %v != %v", parsed.SrcAddr, h.SrcAddr)
+		}
+		if h.DstAddr != nil && parsed.DstAddr.String() != h.DstAddr.String() {
+			t.Fatalf("bad: %v != %v", parsed.DstAddr, h.DstAddr)
+		}
+		if len(parsed.TLVs) != len(h.TLVs) {
+			t.Fatalf("bad: %v", parsed.TLVs)
+		}
+	}
+}
+
+func TestHeaderBuilder(t *testing.T) {
+	src := netip.MustParseAddrPort("10.1.1.1:1000")
+	dst := netip.MustParseAddrPort("20.2.2.2:2000")
+	h := NewHeaderV2(src, dst).
+		WithALPN("h2").
+		WithAuthority("example.com").
+		WithTLV(0xE0, []byte{1, 2, 3})
+
+	b, err := h.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if length := int(b[14])<<8 | int(b[15]); length != len(b)-v2HeaderLen || length != 12+5+14+6 {
+		t.Fatalf("bad: %d", length)
+	}
+
+	parsed := parseBytes(t, b)
+	expected := []TLV{
+		{Type: TLVTypeALPN, Value: []byte("h2")},
+		{Type: TLVTypeAuthority, Value: []byte("example.com")},
+		{Type: 0xE0, Value: []byte{1, 2, 3}},
+	}
+	if !reflect.DeepEqual(parsed.TLVs, expected) {
+		t.Fatalf("bad: %v", parsed.TLVs)
+	}
+	if parsed.SrcAddr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", parsed.SrcAddr)
+	}
+}
+
+func TestHeaderFormat_Invalid(t *testing.T) {
+	headers := []*Header{
+		{Version: 3},
+		{Version: 1, Protocol: "UDP4"},
+		{Version: 1, Command: "LOCAL", Protocol: "TCP4"},
+		{
+			Version:  1,
+			Protocol: "TCP4",
+			SrcAddr:  &net.TCPAddr{IP: net.ParseIP("::1")},
+			DstAddr:  &net.TCPAddr{IP: net.ParseIP("::1")},
+		},
+		{
+			Version:  2,
+			Protocol: "TCP4",
+			SrcAddr:  &net.TCPAddr{IP: net.ParseIP("::1")},
+			DstAddr:  &net.TCPAddr{IP: net.ParseIP("::1")},
+		},
+		{Version: 2, Protocol: "SCTP"},
+	}
+
+	for _, h := range headers {
+		if _, err := h.Format(); err == nil {
+			t.Fatalf("expected error for %+v", h)
+		}
+	}
+}
+
+func TestHeaderFromConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	h := HeaderFromConns(conn, nil)
+	if h.Version != 2 || h.Protocol != "TCP4" {
+		t.Fatalf("bad: %+v", h)
+	}
+	if h.SrcAddr.String() != client.LocalAddr().String() {
+		t.Fatalf("bad: %v", h.SrcAddr)
+	}
+	if h.DstAddr.String() != l.Addr().String() {
+		t.Fatalf("bad: %v", h.DstAddr)
+	}
+	if _, err := h.Format(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestHeaderFormat_V1Normalization(t *testing.T) {
+	v4 := netip.MustParseAddrPort("10.1.1.1:1000")
+	v6 := netip.MustParseAddrPort("[2001:DB8:0:0::1]:2000")
+
+	cases := []struct {
+		h    *Header
+		line string
+	}{
+		{NewHeaderV1(v6, v6), "PROXY TCP6 2001:db8::1 2001:db8::1 2000 2000\r\n"},
+		{NewHeaderV1(v4, v6), "PROXY TCP6 ::ffff:10.1.1.1 2001:db8::1 1000 2000\r\n"},
+		{
+			&Header{
+				Version:  1,
+				Protocol: "TCP4",
+				SrcAddr:  &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+				DstAddr:  &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000},
+			},
+			"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n",
+		},
+	}
+
+	for _, c := range cases {
+		b, err := c.h.Format()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(b) != c.line {
+			t.Fatalf("bad: %q", b)
+		}
+		parseBytes(t, b)
+	}
+
+	// Zones, UDP and LOCAL cannot be written in version 1
+	headers := []*Header{
+		{
+			Version:  1,
+			Protocol: "TCP6",
+			SrcAddr:  &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 1000, Zone: "eth0"},
+			DstAddr:  &net.TCPAddr{IP: net.ParseIP("fe80::2"), Port: 2000},
+		},
+		{Version: 1, Protocol: "UDP4"},
+		{Version: 1, Command: "LOCAL", Protocol: "UNKNOWN"},
+	}
+	for _, h := range headers {
+		if _, err := h.Format(); !errors.Is(err, ErrNotRepresentableV1) {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestHeader_DowngradeToV1(t *testing.T) {
+	src := netip.MustParseAddrPort("10.1.1.1:1000")
+	dst := netip.MustParseAddrPort("20.2.2.2:2000")
+	h, err := NewHeaderV2(src, dst).DowngradeToV1()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf, err := h.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf) != "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n" {
+		t.Fatalf("bad: %q", buf)
+	}
+
+	local := &Header{Version: 2, Command: "LOCAL", Protocol: "UNSPEC"}
+	if h, err := local.DowngradeToV1(); err != nil || h.Protocol != "UNKNOWN" {
+		t.Fatalf("bad: %v %v", h, err)
+	}
+
+	for _, h := range []*Header{
+		NewHeaderV2(src, dst).WithALPN("h2"),
+		{Version: 2, Command: "PROXY", Protocol: "UDP4",
+			SrcAddr: net.UDPAddrFromAddrPort(src), DstAddr: net.UDPAddrFromAddrPort(dst)},
+		{Version: 2, Command: "PROXY", Protocol: "UNIX_STREAM",
+			SrcAddr: &net.UnixAddr{Name: "/a", Net: "unix"}, DstAddr: &net.UnixAddr{Name: "/b", Net: "unix"}},
+	} {
+		if _, err := h.DowngradeToV1(); !errors.Is(err, ErrNotRepresentableV1) {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestHeader_Encode(t *testing.T) {
+	src := netip.MustParseAddrPort("10.1.1.1:1000")
+	dst := netip.MustParseAddrPort("20.2.2.2:2000")
+	h := NewHeaderV2(src, dst).WithALPN("h2")
+
+	e, err := h.Encode(0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected, _ := h.Format()
+	if e.Version() != 2 || !bytes.Equal(e.Bytes(), expected) {
+		t.Fatalf("bad: %v", e.Bytes())
+	}
+	v1, err := NewHeaderV2(src, dst).Encode(1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v1.Version() != 1 || string(v1.Bytes()) != "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n" {
+		t.Fatalf("bad: %q", v1.Bytes())
+	}
+
+	// Changes to the header, even in place, are not reflected
+	h.TLVs[0].Value[0] = 'x'
+	h.SrcAddr = net.TCPAddrFromAddrPort(netip.MustParseAddrPort("10.9.9.9:1000"))
+	if !bytes.Equal(e.Bytes(), expected) {
+		t.Fatalf("bad: %v", e.Bytes())
+	}
+	var buf bytes.Buffer
+	if n, err := e.WriteTo(&buf); err != nil || n != int64(len(expected)) || !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+
+	if _, err := h.Encode(3); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func BenchmarkHeader_Format(b *testing.B) {
+	h := NewHeaderV2(netip.MustParseAddrPort("10.1.1.1:1000"), netip.MustParseAddrPort("20.2.2.2:2000")).WithALPN("h2")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.Format(); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkEncodedHeader_WriteTo(b *testing.B) {
+	h := NewHeaderV2(netip.MustParseAddrPort("10.1.1.1:1000"), netip.MustParseAddrPort("20.2.2.2:2000")).WithALPN("h2")
+	e, err := h.Encode(0)
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := e.WriteTo(io.Discard); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
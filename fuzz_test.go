@@ -0,0 +1,45 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// bufConn is a net.Conn reading from a fixed buffer.
+type bufConn struct {
+	r        *bytes.Reader
+	net.Conn // nil; crash on any unexpected use
+}
+
+func (c *bufConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *bufConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *bufConn) Close() error                { return nil }
+
+func FuzzReadHeader(f *testing.F) {
+	f.Add([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+	f.Add([]byte("PROXY TCP6 ffff::ffff ffff::ffff 1000 2000\r\nping"))
+	f.Add([]byte("PROXY UNKNOWN\r\nping"))
+	f.Add([]byte("PROXY TCP4 \xff\xfe 20.2.2.2 1000 2000\r\n"))
+	f.Add(v2Header(0x1, 0x11, []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0, 0x01, 0xff, 0xff}))
+	f.Add(v2Header(0x1, 0x21, make([]byte, 10)))
+	f.Add([]byte("ping"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := NewConn(&bufConn{r: bytes.NewReader(data)}, 0)
+		conn.unknownOK = true
+		io.ReadAll(conn)
+
+		h := conn.proxyHeader()
+		if h == nil {
+			return
+		}
+		if h.Version != 1 && h.Version != 2 {
+			t.Fatalf("bad: %v", h)
+		}
+		if (h.SrcAddr == nil) != (h.DstAddr == nil) {
+			t.Fatalf("bad: %v", h)
+		}
+	})
+}
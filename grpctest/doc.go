@@ -0,0 +1,3 @@
+// Package grpctest tests serving gRPC on a proxyproto.Listener. It is a
+// separate module so that the main package does not depend on gRPC.
+package grpctest
@@ -0,0 +1,67 @@
+package grpctest
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	proxyproto "github.com/armon/go-proxyproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+func TestPeerAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &proxyproto.Listener{Listener: l, ProxyHeaderTimeout: time.Second}
+
+	// Record the peer address seen by handlers
+	peers := make(chan net.Addr, 1)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if p, ok := peer.FromContext(ctx); ok {
+			peers <- p.Addr
+		}
+		return handler(ctx, req)
+	}))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(pl)
+	defer srv.Stop()
+
+	// The dialer plays the load balancer, prepending a header
+	src := netip.MustParseAddrPort("10.1.1.1:1000")
+	d := &proxyproto.Dialer{
+		HeaderSource: func(conn net.Conn) *proxyproto.Header {
+			dst, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+			return proxyproto.NewHeaderV2(src, dst)
+		},
+	}
+	client, err := grpc.Dial(pl.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(client).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("bad: %v", resp.Status)
+	}
+	if addr := <-peers; addr.String() != src.String() {
+		t.Fatalf("bad: %v", addr)
+	}
+}
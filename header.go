@@ -0,0 +1,159 @@
+package proxyproto
+
+import (
+	"net"
+	"net/netip"
+)
+
+// v1MaxLen is the maximum length of a version 1 header line,
+// including the trailing CRLF.
+const v1MaxLen = 107
+
+// v1LenientMaxLen is the maximum length of a version 1 header line
+// accepted in lenient mode.
+const v1LenientMaxLen = 512
+
+// v1Unknown is the start of a version 1 UNKNOWN header line.
+const v1Unknown = "PROXY UNKNOWN"
+
+// Header is a parsed PROXY protocol header.
+type Header struct {
+	// Version is the protocol version of the header, 1 or 2.
+	Version int
+
+	// Command is "PROXY", or "LOCAL" for version 2 connections
+	// established by the proxy itself, such as health checks.
+	Command string
+
+	// Protocol is the proxied protocol, such as "TCP4", "TCP6" or
+	// "UNKNOWN". Version 2 headers may also carry "UDP4", "UDP6",
+	// "UNIX_STREAM", "UNIX_DGRAM" and "UNSPEC".
+	Protocol string
+
+	// SrcAddr and DstAddr are the addresses of the proxied connection.
+	// They are nil for UNKNOWN, UNSPEC and LOCAL connections.
+	SrcAddr net.Addr
+	DstAddr net.Addr
+
+	// TLVs holds the extensions of a version 2 header.
+	TLVs []TLV
+}
+
+// Addr is the client address of a proxied connection, carrying the
+// header it was read from. It is returned by RemoteAddr when
+// HeaderInRemoteAddr is set.
+type Addr struct {
+	net.Addr
+	Header *Header
+}
+
+// TLVs returns the TLVs of the header.
+func (a *Addr) TLVs() []TLV {
+	return a.Header.TLVs
+}
+
+// NewHeaderV1 returns a version 1 header for a TCP connection between
+// the given addresses.
+func NewHeaderV1(src, dst netip.AddrPort) *Header {
+	return newTCPHeader(1, src, dst)
+}
+
+// NewHeaderV2 returns a version 2 header for a TCP connection between
+// the given addresses.
+func NewHeaderV2(src, dst netip.AddrPort) *Header {
+	return newTCPHeader(2, src, dst)
+}
+
+// HeaderFromConns returns a version 2 header describing client, an
+// accepted connection, to be written to upstream by an intermediate
+// proxy. The source is the client's RemoteAddr, which is the proxied
+// address if client is itself a *Conn, and the destination is its
+// LocalAddr, or upstream's RemoteAddr if that is not an IP address.
+// If the addresses are not IP addresses, a LOCAL header is returned.
+func HeaderFromConns(client net.Conn, upstream net.Conn) *Header {
+	src, ok := addrPort(client.RemoteAddr())
+	if !ok {
+		return &Header{Version: 2, Command: "LOCAL", Protocol: "UNSPEC"}
+	}
+	dst, ok := addrPort(client.LocalAddr())
+	if !ok && upstream != nil {
+		dst, ok = addrPort(upstream.RemoteAddr())
+	}
+	if !ok {
+		return &Header{Version: 2, Command: "LOCAL", Protocol: "UNSPEC"}
+	}
+
+	h := newTCPHeader(2, src, dst)
+	if _, isUDP := client.RemoteAddr().(*net.UDPAddr); isUDP {
+		h.Protocol = "UDP" + h.Protocol[3:]
+		h.SrcAddr = net.UDPAddrFromAddrPort(src)
+		h.DstAddr = net.UDPAddrFromAddrPort(dst)
+	}
+	return h
+}
+
+// WithTLV appends a TLV to the header and returns it, so that TLVs can
+// be chained onto a constructor, as in
+//
+//	NewHeaderV2(src, dst).WithALPN("h2").WithAuthority("example.com")
+//
+// The value is not copied. TLVs are only written in version 2 headers.
+func (h *Header) WithTLV(typ byte, value []byte) *Header {
+	h.TLVs = append(h.TLVs, TLV{Type: typ, Value: value})
+	return h
+}
+
+// WithALPN appends an ALPN TLV holding the application protocol
+// negotiated with the client, such as "h2".
+func (h *Header) WithALPN(protocol string) *Header {
+	return h.WithTLV(TLVTypeALPN, []byte(protocol))
+}
+
+// WithAuthority appends an authority TLV holding the host name sent by
+// the client, typically with TLS SNI.
+func (h *Header) WithAuthority(host string) *Header {
+	return h.WithTLV(TLVTypeAuthority, []byte(host))
+}
+
+// clone returns a copy of the header.
+func (h *Header) clone() *Header {
+	return &Header{
+		Version:  h.Version,
+		Command:  h.Command,
+		Protocol: h.Protocol,
+		SrcAddr:  h.SrcAddr,
+		DstAddr:  h.DstAddr,
+		TLVs:     h.TLVs,
+	}
+}
+
+// addrPort converts a TCP or UDP address to a netip.AddrPort.
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort(), true
+	case *net.UDPAddr:
+		return a.AddrPort(), true
+	}
+	return netip.AddrPort{}, false
+}
+
+func newTCPHeader(version int, src, dst netip.AddrPort) *Header {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	protocol := "TCP6"
+	if src.Addr().Is4() && dst.Addr().Is4() {
+		protocol = "TCP4"
+	} else {
+		// Both addresses must be of the same family
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+	return &Header{
+		Version:  version,
+		Command:  "PROXY",
+		Protocol: protocol,
+		SrcAddr:  net.TCPAddrFromAddrPort(src),
+		DstAddr:  net.TCPAddrFromAddrPort(dst),
+	}
+}
@@ -0,0 +1,96 @@
+package proxyproto
+
+import (
+	"net"
+	"sync"
+)
+
+// clientLimiter counts live connections per client key.
+type clientLimiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	max    int
+	keyFn  func(net.Addr) string
+	counts map[string]int
+}
+
+func newClientLimiter(max int, keyFn func(net.Addr) string) *clientLimiter {
+	if keyFn == nil {
+		keyFn = addrKey
+	}
+	l := &clientLimiter{
+		max:    max,
+		keyFn:  keyFn,
+		counts: make(map[string]int),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire takes a slot for key. If the limit is reached, it fails
+// unless wait is set, in which case it waits for a slot until closed
+// returns true.
+func (l *clientLimiter) acquire(key string, wait bool, closed func() bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.counts[key] >= l.max {
+		if !wait || closed() {
+			return false
+		}
+		l.cond.Wait()
+	}
+	l.counts[key]++
+	return true
+}
+
+// release frees a slot for key. An empty key is a no-op, but still
+// wakes waiters so they can notice closed connections.
+func (l *clientLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if key != "" {
+		l.counts[key]--
+		if l.counts[key] <= 0 {
+			delete(l.counts, key)
+		}
+	}
+	l.cond.Broadcast()
+}
+
+// limitClient takes a limiter slot for the client of the connection,
+// closing the connection if none is available.
+func (p *Conn) limitClient() error {
+	if p.limiter == nil {
+		return nil
+	}
+	addr := p.conn.RemoteAddr()
+	if h := p.addrHeader(); h != nil && h.SrcAddr != nil {
+		addr = h.SrcAddr
+	}
+	key := p.limiter.keyFn(addr)
+
+	closed := func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.closed
+	}
+	if !p.limiter.acquire(key, p.queueOverLimit, closed) {
+		p.conn.Close()
+		return ErrTooManyClientConns
+	}
+
+	p.mu.Lock()
+	closedWhileWaiting := p.closed
+	if !closedWhileWaiting {
+		p.limitKey = key
+	}
+	p.mu.Unlock()
+
+	if closedWhileWaiting {
+		// Close has already run, so the slot must be released here
+		p.limiter.release(key)
+		p.conn.Close()
+		return net.ErrClosed
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package proxyproto
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// dialN opens n connections to addr, keeping them open until the test
+// ends.
+func dialN(t *testing.T, addr string, n int) {
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+}
+
+func TestMaxConns_Block(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l, MaxConns: 1}
+	defer pl.Close()
+	dialN(t, pl.Addr().String(), 2)
+
+	first, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		accepted <- conn
+	}()
+
+	select {
+	case <-accepted:
+		t.Fatalf("accepted over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("accept did not unblock")
+	}
+}
+
+func TestMaxConns_Reject(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l, MaxConns: 1, RejectOverMaxConns: true}
+	defer pl.Close()
+	dialN(t, pl.Addr().String(), 3)
+
+	first, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, err = pl.Accept()
+	if err != ErrTooManyConns {
+		t.Fatalf("err: %v", err)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+		t.Fatalf("expected temporary error: %v", err)
+	}
+
+	first.Close()
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+}
+
+func TestMaxConns_CloseUnblocks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l, MaxConns: 1}
+	dialN(t, pl.Addr().String(), 1)
+	if _, err := pl.Accept(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pl.Close()
+	}()
+	if _, err := pl.Accept(); err != net.ErrClosed {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestMaxConnsPerClientIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l, MaxConnsPerClientIP: 1}
+	defer pl.Close()
+
+	headers := []string{
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping",
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1001 2000\r\nping",
+		"PROXY TCP4 10.1.1.2 20.2.2.2 1000 2000\r\nping",
+	}
+	for _, header := range headers {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(header))
+	}
+
+	var conns []net.Conn
+	for range headers {
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	recv := make([]byte, 4)
+	if _, err := conns[0].Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := conns[1].Read(recv); err != ErrTooManyClientConns {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := conns[2].Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestClientLimiter_Queue(t *testing.T) {
+	l := newClientLimiter(1, nil)
+	never := func() bool { return false }
+	if !l.acquire("a", false, never) {
+		t.Fatalf("expected slot")
+	}
+	if l.acquire("a", false, never) {
+		t.Fatalf("expected limit")
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- l.acquire("a", true, never)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("acquired over the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	l.release("a")
+	if !<-acquired {
+		t.Fatalf("expected slot")
+	}
+}
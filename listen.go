@@ -0,0 +1,27 @@
+package proxyproto
+
+import (
+	"context"
+	"net"
+)
+
+// ListenConfig is like net.ListenConfig, but the listeners it creates
+// are wrapped in a Listener, for frameworks that take a listener
+// factory with the signature of net.ListenConfig.Listen.
+type ListenConfig struct {
+	net.ListenConfig
+
+	// Options are applied to the accepted connections, after those
+	// matching the fields of the Listener.
+	Options []Option
+}
+
+// Listen announces on the local network address. The returned listener
+// is a *Listener, which may be further configured before use.
+func (lc *ListenConfig) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	l, err := lc.ListenConfig.Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{Listener: l, opts: lc.Options}, nil
+}
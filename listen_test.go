@@ -0,0 +1,36 @@
+package proxyproto
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestListenConfig(t *testing.T) {
+	lc := &ListenConfig{Options: []Option{WithHeaderInRemoteAddr()}}
+	l, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	if _, ok := l.(*Listener); !ok {
+		t.Fatalf("bad: %#v", l)
+	}
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	addr, ok := conn.RemoteAddr().(*Addr)
+	if !ok || addr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,238 @@
+// Package loadgen generates random PROXY protocol headers in bulk, for
+// benchmarking servers behind proxies and for testing how they handle
+// malformed headers.
+package loadgen
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net/netip"
+	"strconv"
+
+	proxyproto "github.com/armon/go-proxyproto"
+)
+
+// Corruption is a way of making a generated header invalid.
+type Corruption int
+
+const (
+	// BadSignature alters the last byte of the signature, so that the
+	// header is not recognized and is read as data.
+	BadSignature Corruption = iota
+
+	// Truncated cuts the header short, so that a server waits for the
+	// rest of it until its header timeout.
+	Truncated
+
+	// BadAddress writes an invalid source address in version 1 headers
+	// and an unknown address family in version 2 headers.
+	BadAddress
+
+	// BadLength pads version 1 header lines past their maximum length,
+	// and declares a version 2 length too short for the addresses.
+	BadLength
+)
+
+var corruptions = []Corruption{BadSignature, Truncated, BadAddress, BadLength}
+
+// TLV types reserved for custom use by the specification.
+const (
+	tlvTypeMinCustom = 0xE0
+	tlvTypeMaxCustom = 0xEF
+)
+
+var sigV2 = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// Generator generates random TCP headers. The zero value generates
+// valid version 1 and 2 headers of IPv4 connections without TLVs, using
+// the global random source. A Generator is not safe for concurrent use,
+// so use one per goroutine.
+type Generator struct {
+	// Versions lists the versions to generate, 1 or 2. Both are used
+	// if it is empty.
+	Versions []int
+
+	// IPv6Ratio is the fraction of headers for IPv6 connections.
+	IPv6Ratio float64
+
+	// MaxTLVs is the maximum number of TLVs of random types in the
+	// custom range and random values added to version 2 headers.
+	MaxTLVs int
+
+	// InvalidRatio is the fraction of headers made invalid with one of
+	// Corruptions, or any Corruption if it is empty.
+	InvalidRatio float64
+	Corruptions  []Corruption
+
+	rnd *rand.Rand
+}
+
+// New returns a Generator producing the same headers for the same seed.
+func New(seed int64) *Generator {
+	return &Generator{rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Header returns a random valid header, to be written by a
+// proxyproto.Dialer or with Header.Format.
+func (g *Generator) Header() *proxyproto.Header {
+	src, dst := g.addrs()
+	if g.version() == 1 {
+		return proxyproto.NewHeaderV1(src, dst)
+	}
+	h := proxyproto.NewHeaderV2(src, dst)
+	for i := g.intn(g.MaxTLVs + 1); i > 0; i-- {
+		value := make([]byte, g.intn(33))
+		g.read(value)
+		h.WithTLV(g.tlvType(), value)
+	}
+	return h
+}
+
+// Append appends an encoded random header to dst and returns the
+// extended buffer. Reusing the buffer avoids allocations when
+// generating headers in a loop.
+func (g *Generator) Append(dst []byte) []byte {
+	var corrupt Corruption = -1
+	if g.InvalidRatio > 0 && g.float() < g.InvalidRatio {
+		kinds := g.Corruptions
+		if len(kinds) == 0 {
+			kinds = corruptions
+		}
+		corrupt = kinds[g.intn(len(kinds))]
+	}
+
+	start := len(dst)
+	if g.version() == 1 {
+		dst = g.appendV1(dst, corrupt)
+	} else {
+		dst = g.appendV2(dst, corrupt)
+	}
+	if corrupt == Truncated {
+		dst = dst[:start+1+g.intn(len(dst)-start-1)]
+	}
+	return dst
+}
+
+func (g *Generator) appendV1(dst []byte, corrupt Corruption) []byte {
+	src, dstAddr := g.addrs()
+	start := len(dst)
+	dst = append(dst, "PROXY TCP4 "...)
+	if src.Addr().Is6() {
+		dst[len(dst)-2] = '6'
+	}
+	if corrupt == BadAddress {
+		dst = append(dst, "999.0.0.1"...)
+	} else {
+		dst = src.Addr().AppendTo(dst)
+	}
+	dst = append(dst, ' ')
+	dst = dstAddr.Addr().AppendTo(dst)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, uint64(src.Port()), 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, uint64(dstAddr.Port()), 10)
+	if corrupt == BadLength {
+		for len(dst)-start < 120 {
+			dst = append(dst, ' ')
+		}
+	}
+	dst = append(dst, '\r', '\n')
+	if corrupt == BadSignature {
+		dst[start+4]++
+	}
+	return dst
+}
+
+func (g *Generator) appendV2(dst []byte, corrupt Corruption) []byte {
+	src, dstAddr := g.addrs()
+	start := len(dst)
+	dst = append(dst, sigV2...)
+	fam, addrLen := byte(0x11), 12
+	if src.Addr().Is6() {
+		fam, addrLen = 0x21, 36
+	}
+	if corrupt == BadAddress {
+		fam = 0xF1
+	}
+	dst = append(dst, 0x21, fam, 0, 0)
+	dst = append(dst, src.Addr().AsSlice()...)
+	dst = append(dst, dstAddr.Addr().AsSlice()...)
+	dst = binary.BigEndian.AppendUint16(dst, src.Port())
+	dst = binary.BigEndian.AppendUint16(dst, dstAddr.Port())
+	for i := g.intn(g.MaxTLVs + 1); i > 0; i-- {
+		n := g.intn(33)
+		dst = append(dst, g.tlvType())
+		dst = binary.BigEndian.AppendUint16(dst, uint16(n))
+		for ; n > 0; n-- {
+			dst = append(dst, byte(g.intn(256)))
+		}
+	}
+
+	length := len(dst) - start - 16
+	if corrupt == BadLength {
+		length = addrLen - 1
+		dst = dst[:start+16+length]
+	}
+	binary.BigEndian.PutUint16(dst[start+14:], uint16(length))
+	if corrupt == BadSignature {
+		dst[start+11]++
+	}
+	return dst
+}
+
+// addrs returns random source and destination addresses of the same
+// family, with non-zero ports.
+func (g *Generator) addrs() (src, dst netip.AddrPort) {
+	v6 := g.IPv6Ratio > 0 && g.float() < g.IPv6Ratio
+	return g.addrPort(v6), g.addrPort(v6)
+}
+
+func (g *Generator) addrPort(v6 bool) netip.AddrPort {
+	var b [16]byte
+	g.read(b[:])
+	port := uint16(1 + g.intn(65535))
+	if v6 {
+		// Keep clear of IPv4-mapped addresses, which are unmapped
+		b[0] = 0x20
+		return netip.AddrPortFrom(netip.AddrFrom16(b), port)
+	}
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte{b[0], b[1], b[2], b[3]}), port)
+}
+
+// tlvType returns a random TLV type in the custom range. TLV values are
+// up to 32 random bytes.
+func (g *Generator) tlvType() byte {
+	return byte(tlvTypeMinCustom + g.intn(tlvTypeMaxCustom-tlvTypeMinCustom+1))
+}
+
+func (g *Generator) version() int {
+	if len(g.Versions) == 0 {
+		return 1 + g.intn(2)
+	}
+	return g.Versions[g.intn(len(g.Versions))]
+}
+
+func (g *Generator) intn(n int) int {
+	if g.rnd == nil {
+		return rand.Intn(n)
+	}
+	return g.rnd.Intn(n)
+}
+
+func (g *Generator) float() float64 {
+	if g.rnd == nil {
+		return rand.Float64()
+	}
+	return g.rnd.Float64()
+}
+
+func (g *Generator) read(b []byte) {
+	if g.rnd == nil {
+		// rand.Read is deprecated, so fill b from the global source
+		for i := range b {
+			b[i] = byte(rand.Intn(256))
+		}
+		return
+	}
+	g.rnd.Read(b)
+}
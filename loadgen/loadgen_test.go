@@ -0,0 +1,91 @@
+package loadgen
+
+import (
+	"bytes"
+	"testing"
+
+	proxyproto "github.com/armon/go-proxyproto"
+)
+
+func TestAppend_Valid(t *testing.T) {
+	g := New(1)
+	g.IPv6Ratio = 0.5
+	g.MaxTLVs = 4
+
+	var buf []byte
+	for i := 0; i < 1000; i++ {
+		buf = g.Append(buf[:0])
+		var p proxyproto.HeaderParser
+		n, done, err := p.Feed(append(buf, "data"...))
+		if err != nil {
+			t.Fatalf("err: %v %q", err, buf)
+		}
+		if !done || p.Header() == nil || n != len(buf) {
+			t.Fatalf("bad: %v %d %q", done, n, buf)
+		}
+	}
+}
+
+func TestAppend_Invalid(t *testing.T) {
+	for _, c := range corruptions {
+		g := New(1)
+		g.IPv6Ratio = 0.5
+		g.MaxTLVs = 2
+		g.InvalidRatio = 1
+		g.Corruptions = []Corruption{c}
+
+		for i := 0; i < 100; i++ {
+			buf := g.Append(nil)
+			var p proxyproto.HeaderParser
+			_, done, err := p.Feed(buf)
+			switch c {
+			case BadSignature:
+				if err != nil || !done || p.Header() != nil {
+					t.Fatalf("%d: bad: %v %q", c, err, buf)
+				}
+			case Truncated:
+				if err != nil || done {
+					t.Fatalf("%d: bad: %v %q", c, err, buf)
+				}
+			default:
+				if err == nil {
+					t.Fatalf("%d: expected error: %q", c, buf)
+				}
+			}
+		}
+	}
+}
+
+func TestNew_Deterministic(t *testing.T) {
+	a, b := New(42), New(42)
+	for i := 0; i < 10; i++ {
+		if x, y := a.Append(nil), b.Append(nil); !bytes.Equal(x, y) {
+			t.Fatalf("bad: %q %q", x, y)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	g := New(1)
+	g.Versions = []int{2}
+	g.MaxTLVs = 3
+	for i := 0; i < 100; i++ {
+		h := g.Header()
+		if h.Version != 2 || len(h.TLVs) > 3 {
+			t.Fatalf("bad: %v", h)
+		}
+		if _, err := h.Format(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkAppend(b *testing.B) {
+	g := New(1)
+	g.IPv6Ratio = 0.5
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = g.Append(buf[:0])
+	}
+}
@@ -0,0 +1,39 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io"
+)
+
+// Matcher returns a function reporting whether a stream starts with a
+// version 1 or version 2 header, for connection multiplexers such as
+// cmux that route connections by their first bytes. It reads no more
+// than needed to tell, one byte at a time, so that clients sending less
+// than a signature are not waited for.
+func Matcher() func(r io.Reader) bool {
+	return func(r io.Reader) bool {
+		var buf [1]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return false
+		}
+
+		var sig []byte
+		switch buf[0] {
+		case prefix[0]:
+			sig = prefix
+		case sigV2[0]:
+			sig = sigV2
+		default:
+			return false
+		}
+		for i := 1; i < len(sig); i++ {
+			if _, err := io.ReadFull(r, buf[:]); err != nil {
+				return false
+			}
+			if !bytes.Equal(buf[:], sig[i:i+1]) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,32 @@
+package proxyproto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	match := Matcher()
+	inputs := map[string]bool{
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n": true,
+		string(sigV2) + "\x21\x11\x00\x0c":           true,
+		"PROXY":                                      false,
+		"PROXZ TCP4":                                 false,
+		"GET / HTTP/1.1\r\n":                         false,
+		"\r\n\r\n\x00\r\nQUIZ\n":                     false,
+		"\x16\x03\x01":                               false,
+		"":                                           false,
+	}
+	for input, expected := range inputs {
+		if match(strings.NewReader(input)) != expected {
+			t.Fatalf("bad: %q", input)
+		}
+	}
+
+	// Only the first byte is read from other protocols
+	r := strings.NewReader("GET / HTTP/1.1\r\n")
+	match(r)
+	if r.Len() != len("GET / HTTP/1.1\r\n")-1 {
+		t.Fatalf("bad: %d", r.Len())
+	}
+}
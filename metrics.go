@@ -0,0 +1,154 @@
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// Metrics is a snapshot of the counters of a Listener, suitable for
+// exporting through expvar or Prometheus.
+type Metrics struct {
+	// Accepted is the number of connections returned by Accept.
+	Accepted uint64
+
+	// Proxied and NonProxied count the connections that did and did not
+	// send a header.
+	Proxied    uint64
+	NonProxied uint64
+
+	// ParseErrors counts connections that failed while reading the
+	// header, including timeouts in the middle of a header.
+	ParseErrors uint64
+
+	// ClosedBeforeHeader counts connections that were closed before
+	// sending any data, such as TCP health checks.
+	ClosedBeforeHeader uint64
+
+	// Timeouts counts connections that hit ProxyHeaderTimeout.
+	Timeouts uint64
+
+	// HeaderBytes is the total number of bytes read in headers.
+	HeaderBytes uint64
+
+	// PreReadQueued is the number of connections accepted for
+	// AcceptParsed that wait for a worker to read their header.
+	PreReadQueued uint64
+
+	// PreReadDropped counts connections reset because the queue of
+	// PreReadQueued connections was full.
+	PreReadDropped uint64
+}
+
+// ListenerStats is a snapshot of the header errors of a Listener,
+// broken out by class, for polling exporters. Each failed connection is
+// counted in one class at most.
+type ListenerStats struct {
+	// Timeouts counts connections that hit ProxyHeaderTimeout before
+	// or in the middle of a header.
+	Timeouts uint64
+
+	// MalformedV1 and MalformedV2 count invalid headers of each
+	// version.
+	MalformedV1 uint64
+	MalformedV2 uint64
+
+	// TLVOverflow counts version 2 headers exceeding MaxTLVCount or
+	// MaxTLVBytes.
+	TLVOverflow uint64
+
+	// PolicyRejects counts valid headers refused by AllowedVersions or
+	// VerifyHeader, connections refused by SourceCheck, and those
+	// missing a header with RequireHeaderBeforeWrite.
+	PolicyRejects uint64
+}
+
+// listenerMetrics holds the counters of a Listener.
+type listenerMetrics struct {
+	accepted    atomic.Uint64
+	proxied     atomic.Uint64
+	nonProxied  atomic.Uint64
+	parseErrors atomic.Uint64
+	closedEarly atomic.Uint64
+	timeouts    atomic.Uint64
+	headerBytes atomic.Uint64
+
+	preReadQueued  atomic.Int64
+	preReadDropped atomic.Uint64
+
+	malformedV1   atomic.Uint64
+	malformedV2   atomic.Uint64
+	tlvOverflow   atomic.Uint64
+	policyRejects atomic.Uint64
+}
+
+// record updates the counters with the outcome of reading the header
+// of a connection.
+func (m *listenerMetrics) record(p *Conn, err error) {
+	m.headerBytes.Add(uint64(p.HeaderBytes()))
+	timedOut := p.timedOut
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		timedOut = true
+	}
+	if timedOut {
+		m.timeouts.Add(1)
+	}
+	if err != nil && !timedOut {
+		m.recordClass(p, err)
+	}
+	switch {
+	case err == ErrConnectionClosedBeforeHeader:
+		m.closedEarly.Add(1)
+	case err != nil && err != io.EOF:
+		m.parseErrors.Add(1)
+	case p.proxyHeader() != nil:
+		m.proxied.Add(1)
+	default:
+		m.nonProxied.Add(1)
+	}
+}
+
+// recordClass counts a header error other than a timeout in its class.
+func (m *listenerMetrics) recordClass(p *Conn, err error) {
+	switch {
+	case errors.Is(err, ErrTLVTooLarge):
+		m.tlvOverflow.Add(1)
+	case p.rejected,
+		errors.Is(err, ErrVersionNotAllowed),
+		errors.Is(err, ErrInvalidUpstream),
+		errors.Is(err, ErrHeaderRequired):
+		m.policyRejects.Add(1)
+	case err == ErrConnectionClosedBeforeHeader:
+	case p.lastVersion == 1:
+		m.malformedV1.Add(1)
+	case p.lastVersion == 2:
+		m.malformedV2.Add(1)
+	}
+}
+
+// Stats returns a snapshot of the Listener's header errors by class.
+func (p *Listener) Stats() ListenerStats {
+	return ListenerStats{
+		Timeouts:      p.metrics.timeouts.Load(),
+		MalformedV1:   p.metrics.malformedV1.Load(),
+		MalformedV2:   p.metrics.malformedV2.Load(),
+		TLVOverflow:   p.metrics.tlvOverflow.Load(),
+		PolicyRejects: p.metrics.policyRejects.Load(),
+	}
+}
+
+// Metrics returns a snapshot of the Listener's counters.
+func (p *Listener) Metrics() Metrics {
+	return Metrics{
+		Accepted:           p.metrics.accepted.Load(),
+		Proxied:            p.metrics.proxied.Load(),
+		NonProxied:         p.metrics.nonProxied.Load(),
+		ParseErrors:        p.metrics.parseErrors.Load(),
+		ClosedBeforeHeader: p.metrics.closedEarly.Load(),
+		Timeouts:           p.metrics.timeouts.Load(),
+		HeaderBytes:        p.metrics.headerBytes.Load(),
+		PreReadQueued:      uint64(p.metrics.preReadQueued.Load()),
+		PreReadDropped:     p.metrics.preReadDropped.Load(),
+	}
+}
@@ -0,0 +1,152 @@
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+	defer pl.Close()
+
+	header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	inputs := []string{
+		header + "ping",
+		"ping",
+		"PROXY TCP4 what 20.2.2.2 1000 2000\r\nping",
+	}
+	for _, input := range inputs {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(input))
+	}
+
+	for i := range inputs {
+		conn, err := pl.AcceptProxy()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Read(make([]byte, 4))
+		conn.Close()
+
+		if i == 0 && conn.HeaderBytes() != len(header) {
+			t.Fatalf("bad: %d", conn.HeaderBytes())
+		}
+		if i == 1 && conn.HeaderBytes() != 0 {
+			t.Fatalf("bad: %d", conn.HeaderBytes())
+		}
+	}
+
+	m := pl.Metrics()
+	if m.Accepted != 3 || m.Proxied != 1 || m.NonProxied != 1 || m.ParseErrors != 1 {
+		t.Fatalf("bad: %+v", m)
+	}
+	if m.HeaderBytes != uint64(len(header)+len(inputs[2])-4) {
+		t.Fatalf("bad: %+v", m)
+	}
+}
+
+func TestClosedBeforeHeader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+	defer pl.Close()
+
+	// A health check connects and closes immediately
+	client, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client.Close()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Read(make([]byte, 4))
+	if err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+	if data, err := io.ReadAll(conn); err != nil || len(data) != 0 {
+		t.Fatalf("bad: %q %v", data, err)
+	}
+
+	m := pl.Metrics()
+	if m.ClosedBeforeHeader != 1 || m.ParseErrors != 0 || m.NonProxied != 0 {
+		t.Fatalf("bad: %+v", m)
+	}
+}
+
+func TestStats(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{
+		Listener:           l,
+		ProxyHeaderTimeout: 50 * time.Millisecond,
+		MaxTLVCount:        1,
+		VerifyHeader: func(h *Header) error {
+			if h.SrcAddr.String() == "6.6.6.6:1000" {
+				return errors.New("denied")
+			}
+			return nil
+		},
+	}
+	defer pl.Close()
+
+	addrs := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	tlvs := []byte{0x01, 0x00, 0x02, 'h', '2', 0x02, 0x00, 0x03, 'f', 'o', 'o'}
+	inputs := []string{
+		"PROXY TCP4 what 20.2.2.2 1000 2000\r\n",
+		string(v2Header(0x2, 0x11, addrs)),
+		string(v2Header(0x1, 0x11, append(addrs, tlvs...))),
+		"PROXY TCP4 6.6.6.6 20.2.2.2 1000 2000\r\n",
+		"PROXY TCP4 ",
+	}
+	for _, input := range inputs {
+		client, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer client.Close()
+		client.Write([]byte(input))
+
+		conn, err := pl.AcceptProxy()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := conn.Read(make([]byte, 4)); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+		conn.Close()
+	}
+
+	expected := ListenerStats{
+		Timeouts:      1,
+		MalformedV1:   1,
+		MalformedV2:   1,
+		TLVOverflow:   1,
+		PolicyRejects: 1,
+	}
+	if s := pl.Stats(); s != expected {
+		t.Fatalf("bad: %+v", s)
+	}
+}
@@ -0,0 +1,138 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// MultiListener accepts connections from several listeners, wrapping
+// them all with the same options, so proxies listening on many ports
+// can manage their PROXY settings in one place. Connections from all
+// listeners are delivered through a single Accept.
+type MultiListener struct {
+	listeners []net.Listener
+	opts      []Option
+	results   chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type acceptResult struct {
+	conn *Conn
+	err  error
+}
+
+// NewMultiListener starts accepting connections from listeners,
+// wrapping them with Wrap using opts. The listeners are owned by the
+// MultiListener and closed by its Close.
+func NewMultiListener(listeners []net.Listener, opts ...Option) *MultiListener {
+	m := &MultiListener{
+		listeners: listeners,
+		opts:      opts,
+		results:   make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		m.wg.Add(1)
+		go m.acceptLoop(l)
+	}
+	return m
+}
+
+// acceptLoop accepts connections from l until it fails permanently.
+// Temporary errors are retried with a backoff of up to a second, so
+// that running out of file descriptors does not spin.
+func (m *MultiListener) acceptLoop(l net.Listener) {
+	defer m.wg.Done()
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		var res acceptResult
+		if err != nil {
+			res.err = err
+		} else {
+			res.conn = Wrap(conn, m.opts...)
+		}
+
+		select {
+		case m.results <- res:
+		case <-m.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+
+		if err == nil {
+			delay = 0
+			continue
+		}
+		if !isTemporary(err) {
+			return
+		}
+		delay = acceptBackoff(delay)
+		select {
+		case <-time.After(delay):
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Accept waits for and returns the next connection from any of the
+// listeners. Errors of the individual listeners are returned as well,
+// and listeners failing with temporary errors are retried after a
+// backoff of up to a second.
+func (m *MultiListener) Accept() (net.Conn, error) {
+	conn, err := m.AcceptProxy()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// AcceptProxy is like Accept but returns the concrete *Conn.
+func (m *MultiListener) AcceptProxy() (*Conn, error) {
+	select {
+	case res := <-m.results:
+		return res.conn, res.err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes all the listeners.
+func (m *MultiListener) Close() error {
+	var errs []error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, l := range m.listeners {
+			if err := l.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		m.wg.Wait()
+	})
+	return errors.Join(errs...)
+}
+
+// Addr returns the address of the first listener, or nil if there are
+// none.
+func (m *MultiListener) Addr() net.Addr {
+	if len(m.listeners) == 0 {
+		return nil
+	}
+	return m.listeners[0].Addr()
+}
+
+// Addrs returns the addresses of all the listeners.
+func (m *MultiListener) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(m.listeners))
+	for i, l := range m.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
@@ -0,0 +1,95 @@
+package proxyproto
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMultiListener(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	ml := NewMultiListener(listeners, WithUnknownOK())
+	defer ml.Close()
+
+	for _, addr := range ml.Addrs() {
+		client, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer client.Close()
+		client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+	}
+
+	for range listeners {
+		conn, err := ml.Accept()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+			t.Fatalf("bad: %v", addr)
+		}
+	}
+
+	if err := ml.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := ml.Accept(); err != net.ErrClosed {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestMultiListener_TemporaryError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	ml := NewMultiListener([]net.Listener{&errListener{Listener: l, errs: []error{emfile, emfile, emfile}}})
+	defer ml.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Close()
+	}()
+
+	// The errors are returned, with a growing delay between them
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := ml.Accept(); !isTemporary(err) {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	conn, err := ml.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	if d := time.Since(start); d < 15*time.Millisecond {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestMultiListener_NoListeners(t *testing.T) {
+	ml := NewMultiListener(nil)
+	if addr := ml.Addr(); addr != nil {
+		t.Fatalf("bad: %v", addr)
+	}
+	if err := ml.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
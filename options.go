@@ -0,0 +1,379 @@
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+)
+
+// Option configures a Conn created with Wrap. The options mirror the
+// fields of Listener.
+type Option func(*Conn)
+
+// WithProxyHeaderTimeout sets the maximum time to receive the proxy
+// header. Zero means no timeout.
+func WithProxyHeaderTimeout(timeout time.Duration) Option {
+	return func(p *Conn) {
+		p.proxyHeaderTimeout = timeout
+	}
+}
+
+// WithSourceCheck sets a SourceChecker that is consulted with the
+// address of the connection before reading the header. If it returns
+// an error, the first Read fails with that error and the connection is
+// closed.
+func WithSourceCheck(check SourceChecker) Option {
+	return func(p *Conn) {
+		p.sourceCheck = check
+	}
+}
+
+// WithUnknownOK allows PROXY UNKNOWN headers.
+func WithUnknownOK() Option {
+	return func(p *Conn) {
+		p.unknownOK = true
+	}
+}
+
+// WithLenientV1 accepts version 1 UNKNOWN header lines with trailing
+// data.
+func WithLenientV1() Option {
+	return func(p *Conn) {
+		p.lenientV1 = true
+	}
+}
+
+// WithLenientV1Syntax accepts version 1 header lines ending with a bare
+// LF or written in lowercase.
+func WithLenientV1Syntax() Option {
+	return func(p *Conn) {
+		p.lenientV1Syntax = true
+	}
+}
+
+// WithStrictV1 rejects version 1 ports with leading zeros.
+func WithStrictV1() Option {
+	return func(p *Conn) {
+		p.strictV1 = true
+	}
+}
+
+// WithRejectDuplicateHeader rejects connections where a second header
+// immediately follows the first one.
+func WithRejectDuplicateHeader() Option {
+	return func(p *Conn) {
+		p.rejectDuplicate = true
+	}
+}
+
+// WithDeferHeader stops LocalAddr and RemoteAddr from blocking until
+// the header has been read.
+func WithDeferHeader() Option {
+	return func(p *Conn) {
+		p.deferHeader = true
+	}
+}
+
+// WithOnHeaderParsed sets a function called whenever a header has been
+// parsed.
+func WithOnHeaderParsed(fn func(*Header)) Option {
+	return func(p *Conn) {
+		p.onHeaderParsed = fn
+	}
+}
+
+// WithAllowedVersions restricts the accepted protocol versions.
+func WithAllowedVersions(versions ...int) Option {
+	return func(p *Conn) {
+		p.allowedVersions = versions
+	}
+}
+
+// WithDetectVersions restricts the signatures looked for, passing data
+// starting like a header of another version to the application.
+func WithDetectVersions(versions ...int) Option {
+	return func(p *Conn) {
+		p.detectVersions = versions
+	}
+}
+
+// WithDebugHeaderBytes includes up to n of the first bytes received in
+// header parsing errors, as a *HeaderDumpError.
+func WithDebugHeaderBytes(n int) Option {
+	return func(p *Conn) {
+		p.debugBytes = n
+	}
+}
+
+// WithMaxHeaderBytes limits the total size of the headers read from
+// the connection.
+func WithMaxHeaderBytes(n int) Option {
+	return func(p *Conn) {
+		p.maxHeaderBytes = n
+	}
+}
+
+// WithBaseContext sets the parent of the context returned by
+// Conn.Context.
+func WithBaseContext(ctx context.Context) Option {
+	return func(p *Conn) {
+		p.baseCtx = ctx
+	}
+}
+
+// WithMaxTLVCount limits the number of TLVs in version 2 headers.
+func WithMaxTLVCount(count int) Option {
+	return func(p *Conn) {
+		p.maxTLVCount = count
+	}
+}
+
+// WithMaxTLVBytes limits the total size of TLVs in version 2 headers.
+func WithMaxTLVBytes(n int) Option {
+	return func(p *Conn) {
+		p.maxTLVBytes = n
+	}
+}
+
+// WithHeaderVerifier sets a verifier that must accept each parsed
+// header before it is trusted.
+func WithHeaderVerifier(verify HeaderVerifier) Option {
+	return func(p *Conn) {
+		p.verifyHeader = verify
+	}
+}
+
+// WithHeaderInRemoteAddr makes RemoteAddr return an *Addr carrying the
+// parsed header.
+func WithHeaderInRemoteAddr() Option {
+	return func(p *Conn) {
+		p.headerInAddr = true
+	}
+}
+
+// WithReadHeaderOnWrite reads the header before the first Write, for
+// protocols where the server writes first.
+func WithReadHeaderOnWrite() Option {
+	return func(p *Conn) {
+		p.headerOnWrite = true
+	}
+}
+
+// WithRequireHeaderBeforeWrite reads the header before the first Write,
+// failing it with ErrHeaderRequired if a trusted source sends none.
+func WithRequireHeaderBeforeWrite() Option {
+	return func(p *Conn) {
+		p.headerOnWrite = true
+		p.requireHeader = true
+	}
+}
+
+// WithSkipUntrusted passes connections from untrusted sources through
+// without looking for a header.
+func WithSkipUntrusted() Option {
+	return func(p *Conn) {
+		p.skipUntrusted = true
+	}
+}
+
+// WithFallbackOnError reads a malformed header as application data
+// instead of failing. See Listener.FallbackOnError for the risks.
+func WithFallbackOnError() Option {
+	return func(p *Conn) {
+		p.fallbackOnError = true
+	}
+}
+
+// WithMaxChainedHeaders reads up to n successive headers sent through a
+// chain of proxies.
+func WithMaxChainedHeaders(n int) Option {
+	return func(p *Conn) {
+		p.maxChained = n
+	}
+}
+
+// WithTrace sets hooks observing the reading of the header.
+func WithTrace(trace *HeaderTrace) Option {
+	return func(p *Conn) {
+		p.trace = trace
+	}
+}
+
+// WithHeaderTimeoutFor sets a function choosing the header timeout of the
+// connection from its peer address and whether the source is trusted.
+func WithHeaderTimeoutFor(fn func(addr net.Addr, trusted bool) time.Duration) Option {
+	return func(p *Conn) {
+		p.timeoutFor = fn
+	}
+}
+
+// WithAdaptiveTimeout chooses the header timeout with a, falling back
+// to the one set by WithProxyHeaderTimeout until it has enough samples.
+func WithAdaptiveTimeout(a *AdaptiveTimeout) Option {
+	return func(p *Conn) {
+		p.adaptive = a
+	}
+}
+
+// WithOverrideFor restricts the headers overriding the connection's
+// addresses to those of the given transports.
+func WithOverrideFor(transports ...Transport) Option {
+	return func(p *Conn) {
+		p.overrideFor = transports
+	}
+}
+
+// WithKeepRemoteAddr keeps RemoteAddr returning the address of the
+// socket peer when a header is read.
+func WithKeepRemoteAddr() Option {
+	return func(p *Conn) {
+		p.keepRemoteAddr = true
+	}
+}
+
+// WithRejectWithRST resets connections refused by policy instead of
+// closing them gracefully.
+func WithRejectWithRST() Option {
+	return func(p *Conn) {
+		p.rejectWithRST = true
+	}
+}
+
+// WithOriginalDstFallback makes OriginalDestination read SO_ORIGINAL_DST
+// from the socket when there is no header.
+func WithOriginalDstFallback() Option {
+	return func(p *Conn) {
+		p.origDstFallback = true
+	}
+}
+
+// WithClock sets the clock used for the header timeout and the stale
+// connection timeout.
+func WithClock(c Clock) Option {
+	return func(p *Conn) {
+		p.clock = c
+	}
+}
+
+// WithKeepAlivePeriod enables TCP keep-alives with the given period if
+// positive, or disables them if negative.
+func WithKeepAlivePeriod(period time.Duration) Option {
+	return func(p *Conn) {
+		if period > 0 {
+			p.SetKeepAlive(true)
+			p.SetKeepAlivePeriod(period)
+		} else if period < 0 {
+			p.SetKeepAlive(false)
+		}
+	}
+}
+
+// Wrap wraps a net.Conn that may be speaking the proxy protocol, for
+// connections that are not accepted through a Listener.
+func Wrap(conn net.Conn, opts ...Option) *Conn {
+	pConn := NewConn(conn, 0)
+	for _, opt := range opts {
+		opt(pConn)
+	}
+	return pConn
+}
+
+// NewConnFromBuffered is like Wrap for a connection that has already
+// been wrapped in buffered, as connection multiplexers do, so that data
+// already buffered is not lost and not buffered twice. Reads that find
+// buffered empty go to conn directly. If buffered is too small to hold
+// a header line, it is wrapped in a larger reader, and reads that find
+// that one empty go to buffered.
+func NewConnFromBuffered(conn net.Conn, buffered *bufio.Reader, opts ...Option) *Conn {
+	pConn := &Conn{
+		bufReader: bufio.NewReaderSize(buffered, v1LenientMaxLen),
+		conn:      conn,
+		id:        lastConnID.Add(1),
+	}
+	if pConn.bufReader != buffered {
+		pConn.src = buffered
+	}
+	for _, opt := range opts {
+		opt(pConn)
+	}
+	return pConn
+}
+
+// AttachHeader wraps conn in a Conn that behaves as if h had already
+// been read from it, so that the client identity read on another
+// connection, as returned by DetachHeader, survives replacing it. A nil
+// h means there was no header. h is trusted without any SourceCheck, so
+// it must not come from an untrusted source.
+func AttachHeader(conn net.Conn, h *Header, opts ...Option) *Conn {
+	pConn := Wrap(conn, opts...)
+	pConn.once.Do(func() {})
+	pConn.header = h
+	return pConn
+}
+
+// options returns the Options matching the Listener's configuration.
+func (p *Listener) options() []Option {
+	opts := []Option{
+		WithProxyHeaderTimeout(p.ProxyHeaderTimeout),
+		WithKeepAlivePeriod(p.KeepAlivePeriod),
+		WithAllowedVersions(p.AllowedVersions...),
+		WithOnHeaderParsed(p.OnHeaderParsed),
+		WithMaxTLVCount(p.MaxTLVCount),
+		WithMaxTLVBytes(p.MaxTLVBytes),
+		WithHeaderVerifier(p.VerifyHeader),
+		WithMaxChainedHeaders(p.MaxChainedHeaders),
+		WithTrace(p.Trace),
+		WithHeaderTimeoutFor(p.HeaderTimeoutFor),
+		WithAdaptiveTimeout(p.AdaptiveTimeout),
+		WithClock(p.Clock),
+		WithOverrideFor(p.OverrideFor...),
+		WithDetectVersions(p.DetectVersions...),
+		WithDebugHeaderBytes(p.DebugHeaderBytes),
+		WithMaxHeaderBytes(p.MaxHeaderBytes),
+		WithBaseContext(p.BaseContext),
+	}
+	if p.UnknownOK {
+		opts = append(opts, WithUnknownOK())
+	}
+	if p.RejectDuplicateHeader {
+		opts = append(opts, WithRejectDuplicateHeader())
+	}
+	if p.DeferHeader {
+		opts = append(opts, WithDeferHeader())
+	}
+	if p.LenientV1 {
+		opts = append(opts, WithLenientV1())
+	}
+	if p.LenientV1Syntax {
+		opts = append(opts, WithLenientV1Syntax())
+	}
+	if p.StrictV1 {
+		opts = append(opts, WithStrictV1())
+	}
+	if p.HeaderInRemoteAddr {
+		opts = append(opts, WithHeaderInRemoteAddr())
+	}
+	if p.ReadHeaderOnWrite {
+		opts = append(opts, WithReadHeaderOnWrite())
+	}
+	if p.RequireHeaderBeforeWrite {
+		opts = append(opts, WithRequireHeaderBeforeWrite())
+	}
+	if p.SkipUntrusted {
+		opts = append(opts, WithSkipUntrusted())
+	}
+	if p.FallbackOnError {
+		opts = append(opts, WithFallbackOnError())
+	}
+	if p.KeepRemoteAddr {
+		opts = append(opts, WithKeepRemoteAddr())
+	}
+	if p.RejectWithRST {
+		opts = append(opts, WithRejectWithRST())
+	}
+	if p.OriginalDstFallback {
+		opts = append(opts, WithOriginalDstFallback())
+	}
+	return append(opts, p.opts...)
+}
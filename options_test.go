@@ -0,0 +1,425 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWrap(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var parsed *Header
+	conn := Wrap(server, WithOnHeaderParsed(func(h *Header) { parsed = h }))
+	defer conn.Close()
+
+	go client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(recv, []byte("ping")) {
+		t.Fatalf("bad: %v", recv)
+	}
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+	if addr := conn.ProxyAddr(); addr != server.RemoteAddr() {
+		t.Fatalf("bad: %v", addr)
+	}
+	if parsed == nil {
+		t.Fatalf("header callback not called")
+	}
+}
+
+func TestWrap_SourceCheck(t *testing.T) {
+	untrusted := func(net.Addr) (bool, error) { return false, nil }
+	rejected := func(net.Addr) (bool, error) { return false, ErrInvalidUpstream }
+
+	client, server := net.Pipe()
+	conn := Wrap(server, WithSourceCheck(untrusted))
+	go client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr := conn.RemoteAddr(); addr != server.RemoteAddr() {
+		t.Fatalf("bad: %v", addr)
+	}
+	client.Close()
+
+	client, server = net.Pipe()
+	defer client.Close()
+	conn = Wrap(server, WithSourceCheck(rejected))
+	if _, err := conn.Read(make([]byte, 4)); err != ErrInvalidUpstream {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestWrap_SkipUntrusted(t *testing.T) {
+	untrusted := func(net.Addr) (bool, error) { return false, nil }
+
+	_, server := net.Pipe()
+	header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	inner := &sizeConn{r: bytes.NewReader([]byte(header)), Conn: server}
+	conn := Wrap(inner, WithSourceCheck(untrusted), WithSkipUntrusted())
+
+	recv := make([]byte, 6)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "PROXY " {
+		t.Fatalf("bad: %q", recv)
+	}
+
+	// Nothing may be read ahead into the buffer
+	if len(inner.sizes) != 1 || inner.sizes[0] != len(recv) {
+		t.Fatalf("bad: %v", inner.sizes)
+	}
+	if conn.RemoteAddr() != server.RemoteAddr() {
+		t.Fatalf("bad: %v", conn.RemoteAddr())
+	}
+}
+
+func TestListener_SkipUntrusted(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var parsed bool
+	pl := &Listener{
+		Listener:       l,
+		SourceCheck:    func(net.Addr) (bool, error) { return false, nil },
+		SkipUntrusted:  true,
+		OnHeaderParsed: func(*Header) { parsed = true },
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	recv, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n" {
+		t.Fatalf("bad: %q", recv)
+	}
+	if parsed {
+		t.Fatalf("header parsed from untrusted source")
+	}
+	if m := pl.Metrics(); m.HeaderBytes != 0 {
+		t.Fatalf("bad: %v", m)
+	}
+}
+
+func TestRemoteAddrAsync(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := Wrap(server, WithDeferHeader())
+	defer conn.Close()
+
+	addrs := make(chan net.Addr, 1)
+	conn.RemoteAddrAsync(func(addr net.Addr) { addrs <- addr })
+
+	// The callback only runs once the header has arrived
+	select {
+	case addr := <-addrs:
+		t.Fatalf("bad: %v", addr)
+	default:
+	}
+
+	go client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+	if addr := <-addrs; addr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "ping" {
+		t.Fatalf("bad: %q", recv)
+	}
+}
+
+func TestWrap_HeaderTimeoutFor(t *testing.T) {
+	var trustedArg []bool
+	timeoutFor := func(addr net.Addr, trusted bool) time.Duration {
+		trustedArg = append(trustedArg, trusted)
+		if trusted {
+			return time.Second
+		}
+		return 20 * time.Millisecond
+	}
+
+	// A trusted load balancer may be slow to send the header
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := Wrap(server,
+		WithProxyHeaderTimeout(20*time.Millisecond),
+		WithSourceCheck(func(net.Addr) (bool, error) { return true, nil }),
+		WithHeaderTimeoutFor(timeoutFor))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+	}()
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	// Everyone else gets the short timeout
+	client, server = net.Pipe()
+	defer client.Close()
+	conn = Wrap(server,
+		WithSourceCheck(func(net.Addr) (bool, error) { return false, nil }),
+		WithHeaderTimeoutFor(timeoutFor))
+	start := time.Now()
+	conn.RemoteAddr()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("bad: %v", d)
+	}
+
+	if len(trustedArg) != 2 || !trustedArg[0] || trustedArg[1] {
+		t.Fatalf("bad: %v", trustedArg)
+	}
+}
+
+func TestNewConnFromBuffered(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+
+	// A multiplexer peeked at the start of the stream
+	br := bufio.NewReader(server)
+	if _, err := br.Peek(6); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conn := NewConnFromBuffered(server, br)
+	defer conn.Close()
+	if conn.bufReader != br {
+		t.Fatalf("reader not reused")
+	}
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "ping" {
+		t.Fatalf("bad: %q", recv)
+	}
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	// Small readers are wrapped
+	conn = NewConnFromBuffered(server, bufio.NewReaderSize(server, 16))
+	if conn.bufReader.Size() < v1LenientMaxLen {
+		t.Fatalf("bad: %d", conn.bufReader.Size())
+	}
+}
+
+func TestConnID(t *testing.T) {
+	a := Wrap(&bufConn{r: bytes.NewReader(nil)})
+	b := NewConnFromBuffered(&bufConn{r: bytes.NewReader(nil)}, bufio.NewReader(bytes.NewReader(nil)))
+	if a.ID() == 0 || b.ID() <= a.ID() {
+		t.Fatalf("bad: %d %d", a.ID(), b.ID())
+	}
+}
+
+func TestAttachHeader(t *testing.T) {
+	input := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	orig := Wrap(&bufConn{r: bytes.NewReader([]byte(input))})
+	h := orig.DetachHeader()
+	if h == nil {
+		t.Fatalf("expected header")
+	}
+
+	// The replacement connection does not carry a header itself
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := AttachHeader(server, h, WithHeaderInRemoteAddr())
+	if addr, ok := conn.RemoteAddr().(*Addr); !ok || addr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", conn.RemoteAddr())
+	}
+
+	go client.Write([]byte(input))
+	recv := make([]byte, len(input))
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != input {
+		t.Fatalf("bad: %q", recv)
+	}
+}
+
+func TestAttachHeader_Untrusted(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("PROXY TCP4 6.6.6.6 20.2.2.2 1 2000\r\nping"))
+
+	// A header from an untrusted source is not carried on
+	orig := Wrap(server, WithSourceCheck(func(net.Addr) (bool, error) { return false, nil }))
+	if h := orig.DetachHeader(); h != nil {
+		t.Fatalf("bad: %v", h)
+	}
+	conn := AttachHeader(orig.NetConn(), orig.DetachHeader())
+	if addr := conn.RemoteAddr(); addr != server.RemoteAddr() {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestWrap_KeepRemoteAddr(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := Wrap(server, WithKeepRemoteAddr())
+	defer conn.Close()
+
+	go client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr := conn.RemoteAddr(); addr != server.RemoteAddr() {
+		t.Fatalf("bad: %v", addr)
+	}
+	if addr := conn.LocalAddr().String(); addr != "20.2.2.2:2000" {
+		t.Fatalf("bad: %v", addr)
+	}
+	if h := conn.ProxyHeader(); h == nil || h.SrcAddr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", h)
+	}
+}
+
+func TestOriginalDestination(t *testing.T) {
+	input := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	conn := Wrap(&bufConn{r: bytes.NewReader([]byte(input))}, WithOriginalDstFallback())
+	addr, err := conn.OriginalDestination()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr.String() != "20.2.2.2:2000" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn = Wrap(server)
+	go client.Write([]byte("ping"))
+	addr, err = conn.OriginalDestination()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr != server.LocalAddr() {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestConn_PolicyDecision(t *testing.T) {
+	trusted := func(net.Addr) (bool, error) { return true, nil }
+	untrusted := func(net.Addr) (bool, error) { return false, nil }
+	input := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+
+	cases := []struct {
+		opts     []Option
+		decision PolicyDecision
+	}{
+		{nil, PolicyNone},
+		{[]Option{WithSourceCheck(trusted)}, PolicyUse},
+		{[]Option{WithSourceCheck(trusted), WithRequireHeaderBeforeWrite()}, PolicyRequire},
+		{[]Option{WithSourceCheck(untrusted)}, PolicyIgnore},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		conn := Wrap(server, c.opts...)
+		go client.Write([]byte(input))
+		if d := conn.PolicyDecision(); d != c.decision {
+			t.Fatalf("bad: %v, expected %v", d, c.decision)
+		}
+		client.Close()
+	}
+}
+
+func TestListener_PolicyDecision(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	untrusted := func(net.Addr) (bool, error) { return false, nil }
+	pl := &Listener{Listener: l, SourceCheck: untrusted}
+	defer pl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Close()
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// The decision is known without reading the header
+	pConn := conn.(*Conn)
+	if d := pConn.PolicyDecision(); d != PolicyIgnore {
+		t.Fatalf("bad: %v", d)
+	}
+	ctx := pConn.Context()
+	if c, ok := ConnFromContext(ctx); !ok || c.PolicyDecision() != PolicyIgnore {
+		t.Fatalf("bad: %v", c)
+	}
+}
+
+func TestNewConnFromBuffered_SmallReader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// A header larger than the multiplexer's reader, then data
+	tlvLen := 510 - v2HeaderLen - 12 - 3
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0, 0xE0, byte(tlvLen >> 8), byte(tlvLen)}
+	payload = append(payload, make([]byte, tlvLen)...)
+	data := bytes.Repeat([]byte("x"), 100)
+	go client.Write(append(v2Header(0x1, 0x11, payload), data...))
+
+	br := bufio.NewReaderSize(server, 500)
+	if _, err := br.Peek(500); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conn := NewConnFromBuffered(server, br)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	recv := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(recv, data) {
+		t.Fatalf("bad: %q", recv)
+	}
+}
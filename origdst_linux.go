@@ -0,0 +1,57 @@
+//go:build linux
+
+package proxyproto
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST at the
+// IPv6 level, from the netfilter headers.
+const soOriginalDst = 80
+
+// socketOriginalDst returns the destination of the connection before it
+// was redirected by netfilter, as with an iptables REDIRECT or TPROXY
+// rule.
+func (p *Conn) socketOriginalDst() (net.Addr, error) {
+	local, _ := addrPort(p.conn.LocalAddr())
+	v4 := local.Addr().Unmap().Is4()
+
+	var addr netip.AddrPort
+	var sockErr error
+	err := p.Control(func(fd uintptr) {
+		// The getsockopt wrappers of the syscall package whose result
+		// is large enough for a sockaddr are reused to read one
+		if v4 {
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			// struct sockaddr_in, with the port in network byte order
+			b := mreq.Multiaddr
+			addr = netip.AddrPortFrom(netip.AddrFrom4([4]byte{b[4], b[5], b[6], b[7]}),
+				binary.BigEndian.Uint16(b[2:4]))
+			return
+		}
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		// The port is in network byte order in memory
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		addr = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port[:]))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return net.TCPAddrFromAddrPort(addr), nil
+}
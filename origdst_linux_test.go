@@ -0,0 +1,40 @@
+//go:build linux
+
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestOriginalDestination_NotRedirected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Write([]byte("ping"))
+		conn.Close()
+	}()
+
+	inner, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn := Wrap(inner, WithOriginalDstFallback())
+	defer conn.Close()
+
+	// Without a netfilter redirect there is no original destination
+	if _, err := conn.OriginalDestination(); !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("err: %v", err)
+	}
+}
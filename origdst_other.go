@@ -0,0 +1,10 @@
+//go:build !linux
+
+package proxyproto
+
+import "net"
+
+// socketOriginalDst cannot query netfilter on this platform.
+func (p *Conn) socketOriginalDst() (net.Addr, error) {
+	return nil, ErrUnsupported
+}
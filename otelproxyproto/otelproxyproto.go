@@ -0,0 +1,80 @@
+// Package otelproxyproto records OpenTelemetry spans for the reading of
+// PROXY headers, to trace the latency they add to connection setup. It
+// is a separate module so that the main package does not depend on
+// OpenTelemetry.
+package otelproxyproto
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	proxyproto "github.com/armon/go-proxyproto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/armon/go-proxyproto/otelproxyproto"
+
+// Outcomes of reading a header, recorded as the proxyproto.outcome
+// attribute.
+const (
+	OutcomeParsed  = "parsed"
+	OutcomeAbsent  = "absent"
+	OutcomeTimeout = "timeout"
+	OutcomeError   = "error"
+)
+
+// NewTrace returns a HeaderTrace recording a span named
+// "proxyproto.header" for each header read, to be set as
+// Listener.Trace or passed to WithTrace. The span covers the whole
+// read, has no parent, since connections carry no trace context before
+// the application protocol, and has the attributes proxyproto.version
+// and proxyproto.family, such as "INET", of the header if any,
+// proxyproto.bytes and proxyproto.outcome. If tp is nil, the global
+// TracerProvider is used.
+func NewTrace(tp trace.TracerProvider) *proxyproto.HeaderTrace {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	tracer := tp.Tracer(tracerName)
+
+	return &proxyproto.HeaderTrace{
+		Done: func(conn *proxyproto.Conn, start time.Time, h *proxyproto.Header, err error) {
+			_, span := tracer.Start(context.Background(), "proxyproto.header",
+				trace.WithTimestamp(start),
+				trace.WithSpanKind(trace.SpanKindServer))
+			defer span.End()
+
+			span.SetAttributes(
+				attribute.Int("proxyproto.bytes", conn.HeaderBytes()),
+				attribute.String("proxyproto.outcome", outcome(h, err)),
+			)
+			if h != nil {
+				span.SetAttributes(
+					attribute.Int("proxyproto.version", h.Version),
+					attribute.String("proxyproto.family", proxyproto.Transport(h.Protocol).Family().String()),
+				)
+			}
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+		},
+	}
+}
+
+func outcome(h *proxyproto.Header, err error) string {
+	var timeout *proxyproto.HeaderTimeoutError
+	switch {
+	case errors.As(err, &timeout):
+		return OutcomeTimeout
+	case err != nil:
+		return OutcomeError
+	case h == nil:
+		return OutcomeAbsent
+	}
+	return OutcomeParsed
+}
@@ -0,0 +1,70 @@
+package otelproxyproto
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	proxyproto "github.com/armon/go-proxyproto"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNewTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	inputs := []string{
+		"PROXY TCP6 2001:db8::1 2001:db8::2 1000 2000\r\nping",
+		"ping",
+		"PROXY TCP4 bogus\r\nping",
+	}
+	for _, input := range inputs {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(input))
+			client.Close()
+		}()
+		conn := proxyproto.Wrap(server, proxyproto.WithTrace(NewTrace(tp)))
+		io.ReadAll(conn)
+		conn.Close()
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != len(inputs) {
+		t.Fatalf("bad: %d spans", len(spans))
+	}
+	expected := []map[attribute.Key]attribute.Value{
+		{
+			"proxyproto.outcome": attribute.StringValue(OutcomeParsed),
+			"proxyproto.version": attribute.IntValue(1),
+			"proxyproto.family":  attribute.StringValue("INET6"),
+			"proxyproto.bytes":   attribute.IntValue(len(inputs[0]) - 4),
+		},
+		{
+			"proxyproto.outcome": attribute.StringValue(OutcomeAbsent),
+			"proxyproto.bytes":   attribute.IntValue(0),
+		},
+		{
+			"proxyproto.outcome": attribute.StringValue(OutcomeError),
+		},
+	}
+	for i, span := range spans {
+		if span.Name() != "proxyproto.header" {
+			t.Fatalf("bad: %q", span.Name())
+		}
+		attrs := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		if _, ok := attrs["proxyproto.family"]; i > 0 && ok {
+			t.Fatalf("bad: %v", attrs)
+		}
+		for k, v := range expected[i] {
+			if attrs[k] != v {
+				t.Fatalf("bad: %d %s: %v", i, k, attrs[k])
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// ParseV1Line parses a version 1 header line received out of band, as
+// found in logs or messages. The trailing CRLF is optional, and a bare
+// LF is accepted in its place, as LenientV1Syntax does. UNKNOWN headers
+// are accepted.
+func ParseV1Line(line string) (*Header, error) {
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r") + "\r\n"
+	if !strings.HasPrefix(line, string(prefix)) {
+		return nil, fmt.Errorf("Invalid v1 signature: %q", line)
+	}
+	return parseV1(line, v1Options{unknownOK: true})
+}
+
+// ParseV2Bytes parses a version 2 header received out of band. b must
+// hold exactly one header, signature included.
+func ParseV2Bytes(b []byte) (*Header, error) {
+	if len(b) < v2HeaderLen || !bytes.Equal(b[:len(sigV2)], sigV2) {
+		return nil, fmt.Errorf("Invalid v2 signature or length: %d bytes", len(b))
+	}
+	length := int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) != v2HeaderLen+length {
+		return nil, fmt.Errorf("Invalid v2 length: %d, have %d bytes", length, len(b)-v2HeaderLen)
+	}
+	return parseV2(b[:v2HeaderLen], b[v2HeaderLen:])
+}
+
+// HeaderParser parses a header from a stream fed to it in pieces, so
+// that servers which do not read from a net.Conn, such as event loop
+// based ones, can reuse the parsing of this package. The fields have
+// the same meaning as the Listener fields of the same name. The zero
+// value is ready to use.
+type HeaderParser struct {
+	UnknownOK       bool
+	LenientV1       bool
+	LenientV1Syntax bool
+	StrictV1        bool
+	MaxTLVCount     int
+	MaxTLVBytes     int
+
+	buf    []byte
+	header *Header
+	done   bool
+	err    error
+}
+
+// Feed passes the next bytes of the stream to the parser. Until parsing
+// is done, all of b is consumed. Once it is done, the bytes of b after
+// the first consumed ones are application data, and Header returns the
+// parsed header. If the stream does not start with a header, none of b
+// is consumed and Buffered returns the bytes consumed by earlier calls,
+// which belong to the application too. Errors are returned by every
+// later call.
+func (p *HeaderParser) Feed(b []byte) (consumed int, done bool, err error) {
+	if p.done {
+		return 0, true, p.err
+	}
+
+	prev := len(p.buf)
+	p.buf = append(p.buf, b...)
+	n, h, err := p.parse()
+	switch {
+	case err != nil:
+		p.done, p.err = true, err
+		return 0, true, err
+	case h != nil:
+		p.done, p.header, p.buf = true, h, nil
+		return n - prev, true, nil
+	case n < 0:
+		p.done, p.buf = true, p.buf[:prev]
+		return 0, true, nil
+	}
+	return len(b), false, nil
+}
+
+// Header returns the parsed header, or nil if parsing is not done or
+// the stream did not start with a header.
+func (p *HeaderParser) Header() *Header {
+	return p.header
+}
+
+// Buffered returns the bytes consumed before it was known that the
+// stream does not start with a header.
+func (p *HeaderParser) Buffered() []byte {
+	if p.header != nil {
+		return nil
+	}
+	return p.buf
+}
+
+// Reset prepares the parser for a new stream.
+func (p *HeaderParser) Reset() {
+	p.buf, p.header, p.done, p.err = p.buf[:0], nil, false, nil
+}
+
+// parse parses the buffered bytes. It returns the length and header
+// once a complete header is buffered, a negative length if the stream
+// does not start with a header, and zero if more data is needed.
+func (p *HeaderParser) parse() (int, *Header, error) {
+	switch {
+	case hasSigPrefix(p.buf, prefix, p.LenientV1Syntax):
+		if len(p.buf) < len(prefix) {
+			return 0, nil, nil
+		}
+		return p.parseV1()
+	case hasSigPrefix(p.buf, sigV2, false):
+		if len(p.buf) < len(sigV2) {
+			return 0, nil, nil
+		}
+		return p.parseV2()
+	case len(p.buf) == 0:
+		return 0, nil, nil
+	}
+	return -1, nil, nil
+}
+
+// parseV1 parses a buffered version 1 header line.
+func (p *HeaderParser) parseV1() (int, *Header, error) {
+	maxLen := v1MaxLen
+	if p.LenientV1 {
+		maxLen = v1LenientMaxLen
+	}
+	buf := p.buf
+	if len(buf) > maxLen {
+		buf = buf[:maxLen]
+	}
+	i := bytes.IndexByte(buf, '\n')
+	if i < 0 {
+		if len(buf) == maxLen {
+			return 0, nil, fmt.Errorf("Header line exceeds %d bytes", maxLen)
+		}
+		return 0, nil, nil
+	}
+	h, err := parseV1(string(buf[:i+1]), v1Options{
+		lenient:       p.LenientV1,
+		lenientSyntax: p.LenientV1Syntax,
+		strict:        p.StrictV1,
+		unknownOK:     p.UnknownOK,
+	})
+	return i + 1, h, err
+}
+
+// parseV2 parses a buffered version 2 header.
+func (p *HeaderParser) parseV2() (int, *Header, error) {
+	if len(p.buf) < v2HeaderLen {
+		return 0, nil, nil
+	}
+	fixed := p.buf[:v2HeaderLen]
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	if p.MaxTLVBytes > 0 && length > v2AddrLen(fixed[13])+p.MaxTLVBytes {
+		return 0, nil, ErrTLVTooLarge
+	}
+	if len(p.buf) < v2HeaderLen+length {
+		return 0, nil, nil
+	}
+
+	h, err := parseV2(fixed, p.buf[v2HeaderLen:v2HeaderLen+length])
+	if err != nil {
+		return 0, nil, err
+	}
+	if p.MaxTLVCount > 0 && len(h.TLVs) > p.MaxTLVCount {
+		return 0, nil, ErrTLVTooLarge
+	}
+	return v2HeaderLen + length, h, nil
+}
+
+// hasSigPrefix reports whether b is consistent with starting with sig,
+// that is b and sig agree on their common length, ignoring case if fold
+// is set.
+func hasSigPrefix(b, sig []byte, fold bool) bool {
+	n := len(b)
+	if n > len(sig) {
+		n = len(sig)
+	}
+	return n > 0 && sigMatches(b[:n], sig[:n], fold)
+}
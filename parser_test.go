@@ -0,0 +1,154 @@
+package proxyproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHeaderParser_ByteAtATime(t *testing.T) {
+	stream := []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping")
+
+	var p HeaderParser
+	for i := 0; i < len(stream); i++ {
+		n, done, err := p.Feed(stream[i : i+1])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !done {
+			if n != 1 {
+				t.Fatalf("bad: %d", n)
+			}
+			continue
+		}
+		if i != len("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n")-1 || n != 1 {
+			t.Fatalf("bad: %d %d", i, n)
+		}
+		break
+	}
+	h := p.Header()
+	if h == nil || h.SrcAddr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", h)
+	}
+}
+
+func TestHeaderParser_V2(t *testing.T) {
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	stream := append(v2Header(0x1, 0x11, payload), "ping"...)
+
+	var p HeaderParser
+	if n, done, err := p.Feed(stream[:10]); err != nil || done || n != 10 {
+		t.Fatalf("bad: %d %v %v", n, done, err)
+	}
+	n, done, err := p.Feed(stream[10:])
+	if err != nil || !done {
+		t.Fatalf("bad: %v %v", done, err)
+	}
+	if rest := stream[10+n:]; string(rest) != "ping" {
+		t.Fatalf("bad: %q", rest)
+	}
+	h := p.Header()
+	if h == nil || h.Version != 2 || h.DstAddr.String() != "20.2.2.2:2000" {
+		t.Fatalf("bad: %v", h)
+	}
+}
+
+func TestHeaderParser_NoHeader(t *testing.T) {
+	var p HeaderParser
+	if n, done, err := p.Feed([]byte("PRO")); err != nil || done || n != 3 {
+		t.Fatalf("bad: %d %v %v", n, done, err)
+	}
+	n, done, err := p.Feed([]byte("FIND"))
+	if err != nil || !done || n != 0 {
+		t.Fatalf("bad: %d %v %v", n, done, err)
+	}
+	if p.Header() != nil {
+		t.Fatalf("bad: %v", p.Header())
+	}
+	if !bytes.Equal(p.Buffered(), []byte("PRO")) {
+		t.Fatalf("bad: %q", p.Buffered())
+	}
+
+	p.Reset()
+	if _, done, err := p.Feed([]byte("GET / HTTP/1.1\r\n")); err != nil || !done {
+		t.Fatalf("bad: %v %v", done, err)
+	}
+	if len(p.Buffered()) != 0 {
+		t.Fatalf("bad: %q", p.Buffered())
+	}
+}
+
+func TestHeaderParser_Errors(t *testing.T) {
+	var p HeaderParser
+	_, done, err := p.Feed([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 70000\r\n"))
+	if err == nil || !done {
+		t.Fatalf("bad: %v %v", done, err)
+	}
+	if _, _, err2 := p.Feed([]byte("ping")); err2 != err {
+		t.Fatalf("err: %v", err2)
+	}
+
+	p = HeaderParser{}
+	if _, _, err := p.Feed(bytes.Repeat([]byte("PROXY "), 20)); err == nil {
+		t.Fatalf("expected error for long line")
+	}
+
+	p = HeaderParser{MaxTLVBytes: 4}
+	payload := append(make([]byte, 12), 0x01, 0, 5, 'h', 'e', 'l', 'l', 'o')
+	if _, _, err := p.Feed(v2Header(0x1, 0x11, payload)[:16]); err != ErrTLVTooLarge {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestParseV1Line(t *testing.T) {
+	for _, line := range []string{
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n",
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000",
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\n",
+	} {
+		h, err := ParseV1Line(line)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if h.SrcAddr.String() != "10.1.1.1:1000" || h.DstAddr.String() != "20.2.2.2:2000" {
+			t.Fatalf("bad: %v", h)
+		}
+	}
+
+	if h, err := ParseV1Line("PROXY UNKNOWN"); err != nil || h.Protocol != "UNKNOWN" {
+		t.Fatalf("bad: %v %v", h, err)
+	}
+	for _, line := range []string{
+		"",
+		"GET / HTTP/1.1",
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000",
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping",
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\n\n",
+	} {
+		if _, err := ParseV1Line(line); err == nil {
+			t.Fatalf("expected error: %q", line)
+		}
+	}
+}
+
+func TestParseV2Bytes(t *testing.T) {
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	b := v2Header(0x1, 0x11, payload)
+	h, err := ParseV2Bytes(b)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if h.SrcAddr.String() != "10.1.1.1:1000" || h.DstAddr.String() != "20.2.2.2:2000" {
+		t.Fatalf("bad: %v", h)
+	}
+
+	for _, input := range [][]byte{
+		nil,
+		b[:len(b)-1],
+		append(append([]byte(nil), b...), 'x'),
+		[]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"),
+	} {
+		if _, err := ParseV2Bytes(input); err == nil {
+			t.Fatalf("expected error: %q", input)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package policy
+
+import "net/netip"
+
+// gcpLBRanges are the source ranges of Google Cloud proxy load
+// balancers and health checks.
+var gcpLBRanges = []string{
+	"35.191.0.0/16",
+	"130.211.0.0/22",
+}
+
+// GCPLBRanges returns a policy trusting the published source ranges of
+// Google Cloud proxy load balancers. refresh may be nil.
+func GCPLBRanges(refresh RefreshFunc) *CIDRPolicy {
+	return NewCIDRPolicy(mustParsePrefixes(gcpLBRanges), refresh)
+}
+
+// AWSNLBRanges returns a policy for AWS Network Load Balancers. Unlike
+// GCPLBRanges, it has no ranges built in: an NLB connects to its
+// targets from private addresses in the subnets it is deployed in,
+// which AWS does not publish. The caller must pass the CIDR ranges of
+// those subnets or of the VPC, or return them from refresh; without
+// any, the policy trusts no source. refresh may be nil.
+func AWSNLBRanges(refresh RefreshFunc, subnets ...netip.Prefix) *CIDRPolicy {
+	return NewCIDRPolicy(subnets, refresh)
+}
+
+func mustParsePrefixes(ranges []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, len(ranges))
+	for i, r := range ranges {
+		prefixes[i] = netip.MustParsePrefix(r)
+	}
+	return prefixes
+}
@@ -0,0 +1,116 @@
+// Package policy provides source checks for proxyproto listeners that
+// trust PROXY headers only from known load balancer address ranges,
+// and can require them from those ranges.
+package policy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+
+	proxyproto "github.com/armon/go-proxyproto"
+)
+
+// RefreshFunc fetches the current set of trusted ranges, for example
+// from a cloud provider's published list.
+type RefreshFunc func(context.Context) ([]netip.Prefix, error)
+
+// CIDRPolicy trusts PROXY headers from connections whose address is
+// within a set of CIDR ranges. Connections from other addresses keep
+// their own address. It is safe for concurrent use, so the ranges can
+// be reloaded without recreating listeners.
+//
+// As a SourceCheck, the policy trusts headers from the ranges but does
+// not require them. Use RequireHeader to refuse connections from the
+// ranges that arrive without one.
+type CIDRPolicy struct {
+	mu       sync.RWMutex
+	prefixes []netip.Prefix
+	refresh  RefreshFunc
+}
+
+// NewCIDRPolicy returns a policy trusting the given ranges. If refresh
+// is not nil, Refresh replaces the ranges with the ones it returns.
+func NewCIDRPolicy(prefixes []netip.Prefix, refresh RefreshFunc) *CIDRPolicy {
+	p := &CIDRPolicy{refresh: refresh}
+	p.Update(prefixes)
+	return p
+}
+
+// SourceCheck implements proxyproto.SourceChecker.
+func (p *CIDRPolicy) SourceCheck(addr net.Addr) (bool, error) {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return false, nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RequireHeader sets p as the SourceCheck of l and requires a header
+// from the trusted ranges: reading from a connection of those ranges
+// that sends none fails with proxyproto.ErrHeaderRequired, and its
+// PolicyDecision is proxyproto.PolicyRequire. Connections from other
+// addresses keep their own address. It sets RequireHeaderBeforeWrite,
+// so the header is also read before the first Write.
+func (p *CIDRPolicy) RequireHeader(l *proxyproto.Listener) {
+	l.SourceCheck = p.SourceCheck
+	l.RequireHeaderBeforeWrite = true
+}
+
+// Refresh fetches the ranges with the policy's RefreshFunc and replaces
+// the current ones. On error, the current ranges are kept. It does
+// nothing if the policy has no RefreshFunc.
+func (p *CIDRPolicy) Refresh(ctx context.Context) error {
+	if p.refresh == nil {
+		return nil
+	}
+	prefixes, err := p.refresh(ctx)
+	if err != nil {
+		return err
+	}
+	p.Update(prefixes)
+	return nil
+}
+
+// Update replaces the trusted ranges, for example when reloading
+// configuration. It is safe to call while connections are accepted;
+// connections already accepted are not affected.
+func (p *CIDRPolicy) Update(prefixes []netip.Prefix) {
+	masked := make([]netip.Prefix, len(prefixes))
+	for i, prefix := range prefixes {
+		masked[i] = prefix.Masked()
+	}
+	p.mu.Lock()
+	p.prefixes = masked
+	p.mu.Unlock()
+}
+
+// Prefixes returns the trusted ranges.
+func (p *CIDRPolicy) Prefixes() []netip.Prefix {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]netip.Prefix(nil), p.prefixes...)
+}
+
+// addrIP returns the IP of a TCP or UDP address.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return netip.Addr{}, false
+	}
+	nip, ok := netip.AddrFromSlice(ip)
+	return nip.Unmap(), ok
+}
@@ -0,0 +1,143 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	proxyproto "github.com/armon/go-proxyproto"
+)
+
+func TestGCPLBRanges(t *testing.T) {
+	p := GCPLBRanges(nil)
+
+	cases := map[string]bool{
+		"35.191.10.1":       true,
+		"130.211.3.255":     true,
+		"::ffff:35.191.0.1": true,
+		"130.211.4.0":       false,
+		"10.1.1.1":          false,
+	}
+	for ip, expected := range cases {
+		allowed, err := p.SourceCheck(&net.TCPAddr{IP: net.ParseIP(ip), Port: 1000})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if allowed != expected {
+			t.Fatalf("%s: bad: %v", ip, allowed)
+		}
+	}
+
+	if allowed, _ := p.SourceCheck(&net.UnixAddr{Name: "/tmp/sock"}); allowed {
+		t.Fatalf("unix address trusted")
+	}
+}
+
+func TestAWSNLBRanges_Refresh(t *testing.T) {
+	var fail bool
+	refresh := func(context.Context) ([]netip.Prefix, error) {
+		if fail {
+			return nil, errors.New("unavailable")
+		}
+		return []netip.Prefix{netip.MustParsePrefix("10.2.0.0/16")}, nil
+	}
+
+	p := AWSNLBRanges(refresh, netip.MustParsePrefix("10.1.0.0/16"))
+	addr := &net.TCPAddr{IP: net.ParseIP("10.2.0.1")}
+	if allowed, _ := p.SourceCheck(addr); allowed {
+		t.Fatalf("trusted before refresh")
+	}
+
+	if err := p.Refresh(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if allowed, _ := p.SourceCheck(addr); !allowed {
+		t.Fatalf("not trusted after refresh")
+	}
+
+	// A failed refresh keeps the current ranges
+	fail = true
+	if err := p.Refresh(context.Background()); err == nil {
+		t.Fatalf("expected error")
+	}
+	if allowed, _ := p.SourceCheck(addr); !allowed {
+		t.Fatalf("not trusted after failed refresh")
+	}
+}
+
+func TestCIDRPolicy_Update(t *testing.T) {
+	p := NewCIDRPolicy(nil, nil)
+	addr := &net.TCPAddr{IP: net.ParseIP("10.1.1.1")}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			p.SourceCheck(addr)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		p.Update([]netip.Prefix{netip.MustParsePrefix("10.1.1.7/8")})
+	}
+	<-done
+
+	if allowed, _ := p.SourceCheck(addr); !allowed {
+		t.Fatalf("not trusted after update")
+	}
+	if prefixes := p.Prefixes(); len(prefixes) != 1 || prefixes[0].String() != "10.0.0.0/8" {
+		t.Fatalf("bad: %v", prefixes)
+	}
+
+	p.Update(nil)
+	if allowed, _ := p.SourceCheck(addr); allowed {
+		t.Fatalf("trusted after removal")
+	}
+}
+
+func TestCIDRPolicy_RequireHeader(t *testing.T) {
+	for _, prefix := range []string{"127.0.0.0/8", "10.0.0.0/8"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		pl := &proxyproto.Listener{Listener: l}
+		defer pl.Close()
+		NewCIDRPolicy([]netip.Prefix{netip.MustParsePrefix(prefix)}, nil).RequireHeader(pl)
+
+		// Send data without a header
+		client, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer client.Close()
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		conn, err := pl.AcceptProxy()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		buf := make([]byte, 4)
+		_, err = conn.Read(buf)
+		trusted := prefix == "127.0.0.0/8"
+		if trusted {
+			if err != proxyproto.ErrHeaderRequired {
+				t.Fatalf("err: %v", err)
+			}
+			if d := conn.PolicyDecision(); d != proxyproto.PolicyRequire {
+				t.Fatalf("bad: %v", d)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if d := conn.PolicyDecision(); d != proxyproto.PolicyIgnore {
+			t.Fatalf("bad: %v", d)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package proxyproto
+
+import "net"
+
+// defaultPreReadWorkers is the number of goroutines reading headers for
+// AcceptParsed if PreReadWorkers is not set.
+const defaultPreReadWorkers = 16
+
+// AcceptParsed is like AcceptProxy but returns connections whose header
+// has already been read. Connections are accepted in the background and
+// their headers read by a pool of PreReadWorkers goroutines, so that a
+// slow header does not hold up the connections accepted after it.
+// Connections failing to send a valid header are closed and skipped.
+// AcceptParsed should not be mixed with Accept on the same Listener.
+func (p *Listener) AcceptParsed() (*Conn, error) {
+	p.init()
+	p.preReadOnce.Do(p.startPreRead)
+	select {
+	case res := <-p.parsed:
+		return res.conn, res.err
+	case <-p.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// startPreRead starts the goroutines serving AcceptParsed.
+func (p *Listener) startPreRead() {
+	p.parsed = make(chan acceptResult)
+	pending := make(chan *Conn, p.PreReadQueueSize)
+
+	workers := p.PreReadWorkers
+	if workers <= 0 {
+		workers = defaultPreReadWorkers
+	}
+	for i := 0; i < workers; i++ {
+		go p.preRead(pending)
+	}
+	go p.preReadAccept(pending)
+}
+
+// preReadAccept accepts connections and hands them to the workers until
+// the listener fails permanently.
+func (p *Listener) preReadAccept(pending chan<- *Conn) {
+	defer close(pending)
+	for {
+		conn, err := p.AcceptProxy()
+		if err != nil {
+			select {
+			case p.parsed <- acceptResult{err: err}:
+			case <-p.done:
+				return
+			}
+			if !isTemporary(err) {
+				return
+			}
+			continue
+		}
+
+		p.metrics.preReadQueued.Add(1)
+		if p.PreReadDropOnFull {
+			select {
+			case pending <- conn:
+			default:
+				p.metrics.preReadQueued.Add(-1)
+				p.metrics.preReadDropped.Add(1)
+				conn.SetLinger(0)
+				conn.Close()
+			}
+			continue
+		}
+		select {
+		case pending <- conn:
+		case <-p.done:
+			p.metrics.preReadQueued.Add(-1)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// preRead reads the headers of pending connections.
+func (p *Listener) preRead(pending <-chan *Conn) {
+	for conn := range pending {
+		p.metrics.preReadQueued.Add(-1)
+		if err := conn.checkPrefixOnce(); err != nil {
+			conn.Close()
+			continue
+		}
+		select {
+		case p.parsed <- acceptResult{conn: conn}:
+		case <-p.done:
+			conn.Close()
+		}
+	}
+}
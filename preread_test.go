@@ -0,0 +1,127 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptParsed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l, PreReadWorkers: 2}
+	defer pl.Close()
+
+	// The slow client connects first but sends its header last
+	slow, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer slow.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	fast, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fast.Close()
+	fast.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+
+	conn, err := pl.AcceptParsed()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if addr := conn.proxyHeader().SrcAddr.String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	slow.Write([]byte("PROXY TCP4 10.1.1.2 20.2.2.2 1000 2000\r\n"))
+	conn, err = pl.AcceptParsed()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if addr := conn.proxyHeader().SrcAddr.String(); addr != "10.1.1.2:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestAcceptParsed_SkipsInvalid(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l, PreReadWorkers: 1}
+
+	for _, header := range []string{
+		"PROXY TCP4 what 20.2.2.2 1000 2000\r\n",
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n",
+	} {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(header))
+	}
+
+	conn, err := pl.AcceptParsed()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	pl.Close()
+	if _, err := pl.AcceptParsed(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAcceptParsed_DropOnFull(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{
+		Listener:          l,
+		PreReadWorkers:    1,
+		PreReadQueueSize:  1,
+		PreReadDropOnFull: true,
+	}
+	defer pl.Close()
+	go pl.AcceptParsed()
+
+	// The first client holds the worker, the second waits in the queue
+	// and the third is dropped
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err == nil {
+			defer conn.Close()
+		} else if i < 2 {
+			t.Fatalf("err: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		m := pl.Metrics()
+		if m.PreReadQueued == 1 && m.PreReadDropped == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %+v", m)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
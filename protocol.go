@@ -3,26 +3,173 @@ package proxyproto
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var (
 	// prefix is the string we look for at the start of a connection
 	// to check if this connection is using the proxy protocol
-	prefix    = []byte("PROXY ")
-	prefixLen = len(prefix)
+	prefix = []byte("PROXY ")
+
+	// sigV2 is the binary signature of a version 2 header
+	sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
 
 	ErrInvalidUpstream = errors.New("upstream connection address not trusted for PROXY information")
+
+	// ErrDuplicateHeader is returned when RejectDuplicateHeader is set and
+	// a second PROXY header directly follows the first one.
+	ErrDuplicateHeader = errors.New("duplicate PROXY header")
+
+	// ErrVersionNotAllowed is returned when a header of a protocol
+	// version not listed in AllowedVersions is received.
+	ErrVersionNotAllowed = errors.New("PROXY protocol version not allowed")
+
+	// ErrTooManyConns is returned by Accept when MaxConns is exceeded
+	// and RejectOverMaxConns is set.
+	ErrTooManyConns error = &temporaryError{"too many connections"}
+
+	// ErrTooManyClientConns is returned when MaxConnsPerClientIP is
+	// exceeded for the client of a connection.
+	ErrTooManyClientConns = errors.New("too many connections from client")
+
+	// ErrConnectionClosedBeforeHeader is reported to HeaderTrace and
+	// counted in Metrics when the connection is closed before sending
+	// any data, as TCP health checks do. Read returns io.EOF itself
+	// then, as io.Reader requires. It matches io.EOF with errors.Is and
+	// is not logged.
+	ErrConnectionClosedBeforeHeader = fmt.Errorf("connection closed before header: %w", io.EOF)
+
+	// ErrTLVTooLarge is returned when a version 2 header exceeds
+	// MaxTLVCount or MaxTLVBytes.
+	ErrTLVTooLarge = errors.New("PROXY header TLVs exceed limits")
+
+	// ErrHeaderRequired is returned by Write, and by Read, when
+	// RequireHeaderBeforeWrite is set and a trusted source did not send a
+	// header in time.
+	ErrHeaderRequired = errors.New("PROXY header required before write")
+
+	// ErrAddressFamilyMismatch is returned when an address of a version
+	// 1 header does not match its TCP4 or TCP6 protocol.
+	ErrAddressFamilyMismatch = errors.New("PROXY header address does not match protocol")
+
+	// ErrInvalidAddress is returned when an address of a version 1
+	// header is not a valid IP address.
+	ErrInvalidAddress = errors.New("invalid address in PROXY header")
+
+	// ErrInvalidPort is returned when a port of a version 1 header is
+	// not a decimal number from 0 to 65535, or with StrictV1 has a
+	// leading zero.
+	ErrInvalidPort = errors.New("invalid port in PROXY header")
+
+	// ErrHeaderTooLarge is returned when the headers of a connection
+	// exceed MaxHeaderBytes.
+	ErrHeaderTooLarge = errors.New("PROXY header exceeds MaxHeaderBytes")
+
+	// ErrNotRepresentableV1 is returned when formatting a header that
+	// cannot be expressed in version 1, such as a UDP or LOCAL header.
+	ErrNotRepresentableV1 = errors.New("PROXY header not representable in version 1")
+
+	// ErrUnsupported is returned when an operation is delegated to the
+	// underlying connection but that connection does not support it.
+	ErrUnsupported = errors.New("operation not supported by underlying connection")
 )
 
+// lastConnID is the ID of the last wrapped connection.
+var lastConnID atomic.Uint64
+
+// temporaryError is an error that is reported as temporary, so that
+// accept loops back off and retry instead of giving up.
+type temporaryError struct {
+	msg string
+}
+
+func (e *temporaryError) Error() string   { return e.msg }
+func (e *temporaryError) Timeout() bool   { return false }
+func (e *temporaryError) Temporary() bool { return true }
+
+// AcceptError is returned by Accept when the underlying listener fails.
+// It is a net.Error reporting the Timeout and Temporary status of Err.
+type AcceptError struct {
+	Err error
+}
+
+func (e *AcceptError) Error() string { return "accept: " + e.Err.Error() }
+func (e *AcceptError) Unwrap() error { return e.Err }
+
+func (e *AcceptError) Timeout() bool {
+	return isTimeout(e.Err)
+}
+
+func (e *AcceptError) Temporary() bool {
+	return isTemporary(e.Err)
+}
+
+// isTemporary reports whether err is a temporary net.Error.
+func isTemporary(err error) bool {
+	var neterr net.Error
+	return errors.As(err, &neterr) && neterr.Temporary()
+}
+
+// isTimeout reports whether err is a net.Error that timed out.
+func isTimeout(err error) bool {
+	var neterr net.Error
+	return errors.As(err, &neterr) && neterr.Timeout()
+}
+
+// acceptBackoff returns the delay before retrying a temporary accept
+// error, doubling the previous delay up to a second.
+func acceptBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		delay = time.Second
+	}
+	return delay
+}
+
+// HeaderTimeoutError is returned when ProxyHeaderTimeout expires while
+// a header is being read, to distinguish a slow load balancer from a
+// malformed header. It is a net.Error whose Timeout method returns true.
+type HeaderTimeoutError struct {
+	Err error
+}
+
+func (e *HeaderTimeoutError) Error() string {
+	return "timeout reading PROXY header: " + e.Err.Error()
+}
+
+func (e *HeaderTimeoutError) Unwrap() error   { return e.Err }
+func (e *HeaderTimeoutError) Timeout() bool   { return true }
+func (e *HeaderTimeoutError) Temporary() bool { return true }
+
+// HeaderDumpError is returned in place of a header parsing error when
+// DebugHeaderBytes is set, carrying the first bytes received to help
+// identify the sender.
+type HeaderDumpError struct {
+	Err  error
+	Data []byte
+}
+
+func (e *HeaderDumpError) Error() string {
+	return fmt.Sprintf("%v (received % x)", e.Err, e.Data)
+}
+
+func (e *HeaderDumpError) Unwrap() error { return e.Err }
+
 // SourceChecker can be used to decide whether to trust the PROXY info or pass
 // the original connection address through. If set, the connecting address is
 // passed in as an argument. If the function returns an error due to the source
@@ -39,47 +186,452 @@ var (
 type SourceChecker func(net.Addr) (bool, error)
 
 // Listener is used to wrap an underlying listener,
-// whose connections may be using the HAProxy Proxy Protocol (version 1).
+// whose connections may be using the HAProxy Proxy Protocol (version 1 or 2).
 // If the connection is using the protocol, the RemoteAddr() will return
-// the correct client address.
+// the correct client address. The underlying listener need not be a TCP
+// listener: when wrapping a unix socket listener, RemoteAddr() returns
+// the TCP or UDP address from the header instead of the unix peer.
 //
 // Optionally define ProxyHeaderTimeout to set a maximum time to
-// receive the Proxy Protocol Header. Zero means no timeout.
+// receive the Proxy Protocol Header. Zero means no timeout. The timeout
+// bounds the total time spent reading the header, however many
+// segments it arrives in, including version 2 TLVs and chained headers.
+//
+// BaseContext, if set, is the parent of the contexts returned by
+// Conn.Context() for accepted connections.
+//
+// If MaxHeaderBytes is positive, it bounds the total size of the headers
+// read from a connection, including chained headers. Connections
+// announcing more fail with ErrHeaderTooLarge before it is read.
+//
+// If RejectDuplicateHeader is set, connections where a second PROXY
+// header immediately follows the first one are rejected. This guards
+// against a client behind the proxy prepending its own header in an
+// attempt to spoof its address. Data received along with the header is
+// checked when it is read, but waiting for more is left to the first
+// Read, so that RemoteAddr and Write do not block on clients waiting
+// for the server to speak first.
+//
+// If KeepAlivePeriod is positive, TCP keep-alives are enabled on accepted
+// connections with that period. If negative, keep-alives are disabled.
+// Zero leaves the underlying listener's behavior unchanged.
+//
+// If DeferHeader is set, LocalAddr() and RemoteAddr() no longer block
+// waiting for the header. Until the header has been read by the first
+// Read(), they return the addresses of the socket, switching to the
+// proxied addresses afterwards. OnHeaderParsed, if set, is called
+// whenever a header has been parsed.
+//
+// AllowedVersions restricts the accepted protocol versions (1 or 2).
+// Connections sending a header of any other version are rejected. If
+// empty, all versions are accepted.
+//
+// If SourceCheckCacheSize is positive, SourceCheck decisions are cached
+// per upstream IP in an LRU of that size, so SourceCheck is not invoked
+// for every connection. Entries expire after SourceCheckCacheTTL, or
+// never if it is zero.
+//
+// If MaxConns is positive, at most that many accepted connections may
+// be open at once. Accept blocks until a connection is closed, or, if
+// RejectOverMaxConns is set, closes the excess connection and returns
+// ErrTooManyConns, which is a temporary net.Error.
+//
+// If MaxConnsPerClientIP is positive, at most that many connections
+// from the same client, as identified by the proxied source address,
+// may be open at once. Once the header has been read, excess
+// connections are closed with ErrTooManyClientConns or, if
+// QueueOverClientLimit is set, wait for another connection of the
+// client to close. ClientKey may be set to customize how addresses are
+// grouped, it defaults to the IP address.
+//
+// ConnCallbacks may be set to observe the lifecycle of accepted
+// connections.
+//
+// If LenientV1 is set, version 1 UNKNOWN header lines with trailing
+// data, possibly beyond the maximum line length of the specification,
+// are accepted and treated as UNKNOWN, as sent by some legacy
+// appliances. Off by default.
+//
+// If LenientV1Syntax is set, version 1 header lines ending with a bare
+// LF, or written in lowercase, are accepted, as sent by some homegrown
+// proxies. Off by default, as the specification requires uppercase and
+// CRLF, and data from direct clients starting with "proxy " is then
+// taken for a header.
+//
+// If StrictV1 is set, ports of version 1 headers with leading zeros are
+// rejected, so that all parsers along the way agree on the port, which
+// some implementations read as octal.
+//
+// MaxTLVCount and MaxTLVBytes, if positive, limit the number of TLVs and
+// their total size in version 2 headers. Headers exceeding them are
+// rejected with ErrTLVTooLarge.
+//
+// If VerifyHeader is set, it must accept each parsed header before it
+// is trusted, for example with HMACVerifier, as defense in depth where
+// source address checks are not enough.
+//
+// If HeaderInRemoteAddr is set, RemoteAddr() returns an *Addr carrying
+// the parsed header for proxied connections, so frameworks that only
+// surface RemoteAddr() can still propagate it.
+//
+// For protocols where the server writes first, such as SMTP or FTP, the
+// header is normally not read until the first Read(), so RemoteAddr()
+// may change after writing. ReadHeaderOnWrite reads the header before
+// the first Write(), and ReadHeaderOnAccept reads it in Accept(), which
+// then blocks until the header arrives or ProxyHeaderTimeout expires.
+//
+// RequireHeaderBeforeWrite is a stricter ReadHeaderOnWrite for
+// write-first protocols that rely on the header, such as SMTP servers
+// using it instead of XCLIENT. If a trusted source sends no header
+// within ProxyHeaderTimeout, Write fails with ErrHeaderRequired and the
+// connection is left open, so that a reply such as 421 can be written
+// to NetConn() before closing it. See WriteGreeting.
+//
+// If SkipUntrusted is set, connections from sources that SourceCheck
+// does not trust are passed through without looking for a header at
+// all, so they cannot make the listener buffer data or parse headers.
+//
+// Errors of the underlying listener are returned as *AcceptError. If
+// RetryTemporaryAccept is set, temporary errors, such as running out of
+// file descriptors, are retried with a backoff of up to a second
+// instead, so that simple accept loops do not exit on them.
+//
+// PreReadWorkers sets the number of goroutines reading headers for
+// AcceptParsed, 16 by default. Up to PreReadQueueSize accepted
+// connections wait for a worker. Once the queue is full, accepting
+// blocks, or if PreReadDropOnFull is set, connections are reset right
+// away, shedding bursts of connections that would otherwise pile up.
+//
+// If MaxChainedHeaders is greater than one, up to that many successive
+// headers are read, as sent through a chain of proxies that each add
+// their own. The last header, added by the proxy closest to the client,
+// provides the addresses and the whole chain is available from
+// HeaderChain(). The presence of another header is checked by waiting
+// for data after each header, as with RejectDuplicateHeader.
+//
+// Trace may be set to observe the reading of headers in detail.
+//
+// ProxyHeaderTimeout normally starts when the header is first needed,
+// by Read() or RemoteAddr(). If HeaderTimeoutFromAccept is set, the
+// header is read in the background from Accept() on instead, so the
+// timeout counts from Accept() even if the application has not used
+// the connection yet.
+//
+// If StaleConnTimeout is positive, accepted connections over which
+// nothing at all has been received after that duration are closed, to
+// free the file descriptors held by port scanners that connect and go
+// silent. This requires checking the socket for data the application
+// has not read yet, so it only applies to connections implementing
+// syscall.Conn on Unix systems. Connections passed to io.Copy as the
+// source, which uses WriteTo, are no longer tracked once it starts.
+//
+// If HeaderTimeoutFor is set, it returns the header timeout to use in
+// place of ProxyHeaderTimeout for each connection, given the address of
+// the socket peer and whether SourceCheck trusts it. This allows, for
+// example, a generous timeout for load balancers and a short one for
+// everyone else.
+//
+// If RejectWithRST is set, connections refused by SourceCheck,
+// AllowedVersions or VerifyHeader are reset instead of closed
+// gracefully, so that misbehaving clients fail right away and the
+// server does not accumulate sockets in TIME_WAIT.
+//
+// If OriginalDstFallback is set, OriginalDestination() of connections
+// without a header returns the destination they had before being
+// redirected by netfilter on Linux, read with SO_ORIGINAL_DST, so that
+// transparent proxies get it the same way whether a load balancer sent
+// a header or iptables redirected the connection.
+//
+// Clock is the source of time for header timeouts, StaleConnTimeout and
+// SourceCheckCacheTTL. It defaults to the system clock and may be set to
+// a FakeClock to test timeouts without waiting for them.
+//
+// If AdaptiveTimeout is set, the header timeout of connections is
+// chosen by it from the time recent headers took to arrive, and
+// ProxyHeaderTimeout is only used until it has enough samples. It is
+// overridden by HeaderTimeoutFor.
+//
+// If OverrideFor is set, only headers of the listed transports, such as
+// TCP4 and TCP6, override RemoteAddr() and LocalAddr(). Others are
+// still parsed and available from ProxyHeader().
+//
+// If KeepRemoteAddr is set, RemoteAddr() returns the address of the
+// socket peer even when a header was read, so that firewalling and
+// logging keep seeing the proxy, while the client address is read from
+// ProxyHeader(). LocalAddr() is still overridden.
+//
+// If FallbackOnError is set, a malformed header does not fail the
+// connection. It is left unconsumed and read by the application as
+// data, byte for byte, and the connection keeps the addresses of the
+// socket. Use with care: a client able to reach the listener only
+// through a proxy can corrupt its own header and appear to come from the
+// proxy, defeating access control based on RemoteAddr(). Timeouts and
+// headers refused by AllowedVersions or VerifyHeader still fail.
+//
+// DetectVersions restricts the signatures looked for at the start of
+// connections, by version (1 or 2) as with AllowedVersions. Unlike with
+// AllowedVersions, data starting like a header of another version is
+// not rejected but passed to the application, so setting it to 2 alone
+// keeps line based protocols with commands that may start with "PROXY"
+// from being mistaken for version 1 headers. If empty, all versions are
+// detected.
+//
+// If DebugHeaderBytes is positive, errors parsing a header are returned
+// as a *HeaderDumpError holding up to that many of the first bytes
+// received, which are printed in hex by its Error method. This helps
+// finding which device sends garbage, but the bytes end up in logs.
 type Listener struct {
-	Listener           net.Listener
-	ProxyHeaderTimeout time.Duration
-	SourceCheck        SourceChecker
-	UnknownOK          bool // allow PROXY UNKNOWN
+	Listener                 net.Listener
+	ProxyHeaderTimeout       time.Duration
+	SourceCheck              SourceChecker
+	UnknownOK                bool // allow PROXY UNKNOWN
+	RejectDuplicateHeader    bool
+	KeepAlivePeriod          time.Duration
+	DeferHeader              bool
+	OnHeaderParsed           func(*Header)
+	AllowedVersions          []int
+	SourceCheckCacheSize     int
+	SourceCheckCacheTTL      time.Duration
+	MaxConns                 int
+	RejectOverMaxConns       bool
+	MaxConnsPerClientIP      int
+	QueueOverClientLimit     bool
+	ClientKey                func(net.Addr) string
+	ConnCallbacks            ConnCallbacks
+	LenientV1                bool
+	LenientV1Syntax          bool
+	StrictV1                 bool
+	MaxTLVCount              int
+	MaxTLVBytes              int
+	VerifyHeader             HeaderVerifier
+	HeaderInRemoteAddr       bool
+	ReadHeaderOnWrite        bool
+	ReadHeaderOnAccept       bool
+	RequireHeaderBeforeWrite bool
+	SkipUntrusted            bool
+	RetryTemporaryAccept     bool
+	PreReadWorkers           int
+	PreReadQueueSize         int
+	PreReadDropOnFull        bool
+	MaxChainedHeaders        int
+	Trace                    *HeaderTrace
+	HeaderTimeoutFromAccept  bool
+	StaleConnTimeout         time.Duration
+	HeaderTimeoutFor         func(addr net.Addr, trusted bool) time.Duration
+	AdaptiveTimeout          *AdaptiveTimeout
+	OverrideFor              []Transport
+	KeepRemoteAddr           bool
+	RejectWithRST            bool
+	OriginalDstFallback      bool
+	Clock                    Clock
+	FallbackOnError          bool
+	DetectVersions           []int
+	DebugHeaderBytes         int
+	MaxHeaderBytes           int
+	BaseContext              context.Context
+
+	opts        []Option
+	initOnce    sync.Once
+	cache       *decisionCache
+	sem         chan struct{}
+	limiter     *clientLimiter
+	done        chan struct{}
+	closeOnce   sync.Once
+	metrics     listenerMetrics
+	preReadOnce sync.Once
+	parsed      chan acceptResult
+	disabled    atomic.Bool
+	swapMu      sync.RWMutex
+	swaps       uint64
+	serving     atomic.Int64
+	shutdown    atomic.Bool
+	returnedMu  sync.Mutex
+	returned    []*Conn
 }
 
 // Conn is used to wrap and underlying connection which
 // may be speaking the Proxy Protocol. If it is, the RemoteAddr() will
 // return the address of the client instead of the proxy address.
+// As with net.Conn, its methods may be called concurrently.
 type Conn struct {
 	bufReader          *bufio.Reader
+	src                io.Reader
+	readMu             sync.Mutex
 	conn               net.Conn
-	dstAddr            *net.TCPAddr
-	srcAddr            *net.TCPAddr
+	mu                 sync.Mutex
+	header             *Header
+	headerReadDuration time.Duration
 	useConnAddr        bool
 	once               sync.Once
 	proxyHeaderTimeout time.Duration
 	unknownOK          bool
+	rejectDuplicate    bool
+	deferHeader        bool
+	onHeaderParsed     func(*Header)
+	allowedVersions    []int
+	lenientV1          bool
+	lenientV1Syntax    bool
+	strictV1           bool
+	maxTLVCount        int
+	maxTLVBytes        int
+	verifyHeader       HeaderVerifier
+	headerInAddr       bool
+	headerOnWrite      bool
+	peekBuffered       bool
+	dupPending         bool
+	dupDone            bool
+	dupErr             error
+	requireHeader      bool
+	skipUntrusted      bool
+	maxChained         int
+	chain              []*Header
+	trace              *HeaderTrace
+	staleTimer         Timer
+	received           atomic.Bool
+	headerErr          error
+	decision           PolicyDecision
+	failed             atomic.Bool
+	timeoutFor         func(net.Addr, bool) time.Duration
+	adaptive           *AdaptiveTimeout
+	overrideFor        []Transport
+	keepRemoteAddr     bool
+	rejectWithRST      bool
+	origDstFallback    bool
+	clock              Clock
+	fallbackOnError    bool
+	detectVersions     []int
+	debugBytes         int
+	maxHeaderBytes     int
+	baseCtx            context.Context
+	id                 uint64
+	sourceCheck        SourceChecker
+	onClose            func()
+	closeOnce          sync.Once
+	closed             bool
+	limiter            *clientLimiter
+	limitKey           string
+	queueOverLimit     bool
+	headerLen          int
+	timedOut           bool
+	lastVersion        int
+	rejected           bool
+	metrics            *listenerMetrics
+	callbacks          *ConnCallbacks
 }
 
 // Accept waits for and returns the next connection to the listener.
+// While the listener is disabled with SetEnabled, the connections of
+// the underlying listener are returned as they are.
 func (p *Listener) Accept() (net.Conn, error) {
+	if conn := p.takeReturned(); conn != nil {
+		return conn, nil
+	}
+	if p.disabled.Load() {
+		conn, err := p.acceptInner()
+		if err != nil {
+			return nil, &AcceptError{Err: err}
+		}
+		return conn, nil
+	}
+	conn, err := p.AcceptProxy()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// AcceptProxy is like Accept but returns the concrete *Conn, giving
+// access to its header without a type assertion. While the listener is
+// disabled, the returned connections do not look for a header.
+func (p *Listener) AcceptProxy() (*Conn, error) {
+	p.init()
+	if conn := p.takeReturned(); conn != nil {
+		return conn, nil
+	}
+	return p.acceptProxy()
+}
+
+// acceptProxy accepts a new connection, ignoring those queued by
+// giveBack.
+func (p *Listener) acceptProxy() (*Conn, error) {
+	if p.sem != nil && !p.RejectOverMaxConns {
+		select {
+		case p.sem <- struct{}{}:
+		case <-p.done:
+			return nil, net.ErrClosed
+		}
+	}
+
+	conn, err := p.accept()
+	if err != nil && !p.RejectOverMaxConns {
+		p.release()
+	}
+	return conn, err
+}
+
+// giveBack queues a connection accepted by SelfCheck that was not its
+// own, to be returned by the next Accept.
+func (p *Listener) giveBack(conn *Conn) {
+	p.returnedMu.Lock()
+	p.returned = append(p.returned, conn)
+	p.returnedMu.Unlock()
+}
+
+// takeReturned returns the oldest connection queued by giveBack, or nil.
+func (p *Listener) takeReturned() *Conn {
+	p.returnedMu.Lock()
+	defer p.returnedMu.Unlock()
+	if len(p.returned) == 0 {
+		return nil
+	}
+	conn := p.returned[0]
+	p.returned = p.returned[1:]
+	return conn
+}
+
+// accept accepts the next connection that passes SourceCheck. When
+// RejectOverMaxConns is set, it takes a connection slot for it.
+func (p *Listener) accept() (*Conn, error) {
 	// Get the underlying connection
+	var delay time.Duration
 	for {
-		conn, err := p.Listener.Accept()
+		conn, err := p.acceptInner()
 		if err != nil {
-			return nil, err
+			// A deadline set on the listener ends the wait even
+			// though its timeout is temporary.
+			if !p.RetryTemporaryAccept || !isTemporary(err) || isTimeout(err) {
+				return nil, &AcceptError{Err: err}
+			}
+			delay = acceptBackoff(delay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-p.done:
+				return nil, &AcceptError{Err: net.ErrClosed}
+			}
+		}
+		delay = 0
+		if p.sem != nil && p.RejectOverMaxConns {
+			select {
+			case p.sem <- struct{}{}:
+			default:
+				conn.Close()
+				return nil, ErrTooManyConns
+			}
 		}
 		var useConnAddr bool
 		if p.SourceCheck != nil {
-			allowed, err := p.SourceCheck(conn.RemoteAddr())
+			allowed, err := p.sourceCheck(conn.RemoteAddr())
 			if err != nil {
+				if p.RejectWithRST {
+					setLingerZero(conn)
+				}
+				conn.Close()
+				if p.RejectOverMaxConns {
+					p.release()
+				}
+				p.metrics.policyRejects.Add(1)
 				if err == ErrInvalidUpstream {
-					conn.Close()
 					continue
 				}
 				return nil, err
@@ -88,21 +640,144 @@ func (p *Listener) Accept() (net.Conn, error) {
 				useConnAddr = true
 			}
 		}
-		newConn := NewConn(conn, p.ProxyHeaderTimeout)
+		newConn := Wrap(conn, p.options()...)
 		newConn.useConnAddr = useConnAddr
-		newConn.unknownOK = p.UnknownOK
+		if p.SourceCheck != nil {
+			newConn.setDecision(!useConnAddr)
+		}
+		if p.disabled.Load() {
+			newConn.useConnAddr = true
+			newConn.skipUntrusted = true
+			newConn.setDecision(false)
+		}
+		if p.sem != nil {
+			newConn.onClose = p.release
+		}
+		newConn.limiter = p.limiter
+		newConn.queueOverLimit = p.QueueOverClientLimit
+		newConn.metrics = &p.metrics
+		newConn.callbacks = &p.ConnCallbacks
+
+		// The header may be read right away below, which must be
+		// noticed by the reaper and not race with arming it
+		if p.StaleConnTimeout > 0 {
+			newConn.staleTimer = newConn.afterFunc(p.StaleConnTimeout, newConn.reapIfStale)
+		}
+		if p.ReadHeaderOnAccept {
+			newConn.checkPrefixOnce()
+		}
+		p.metrics.accepted.Add(1)
+		if p.ConnCallbacks.OnAccept != nil {
+			p.ConnCallbacks.OnAccept(newConn)
+		}
+		if p.HeaderTimeoutFromAccept {
+			go newConn.checkPrefixOnce()
+		}
 		return newConn, nil
 	}
 }
 
+// acceptInner accepts a connection from the underlying listener. If the
+// listener is swapped while waiting, failures of the old one are not
+// reported and the new one is used instead.
+func (p *Listener) acceptInner() (net.Conn, error) {
+	for {
+		l, gen := p.inner()
+		conn, err := l.Accept()
+		if _, cur := p.inner(); err != nil && cur != gen {
+			continue
+		}
+		return conn, err
+	}
+}
+
+// inner returns the underlying listener and the number of times it was
+// swapped.
+func (p *Listener) inner() (net.Listener, uint64) {
+	p.swapMu.RLock()
+	defer p.swapMu.RUnlock()
+	return p.Listener, p.swaps
+}
+
+// Swap replaces the underlying listener with inner, for example with
+// one received from a parent process during a restart, and returns the
+// previous one. All settings are kept, so there is no window in which
+// connections are accepted without handling headers. Accept calls
+// waiting on the previous listener keep using it until it is closed by
+// the caller, and then continue with inner.
+func (p *Listener) Swap(inner net.Listener) net.Listener {
+	p.swapMu.Lock()
+	defer p.swapMu.Unlock()
+	old := p.Listener
+	p.Listener = inner
+	p.swaps++
+	return old
+}
+
+// release frees a connection slot taken in Accept.
+func (p *Listener) release() {
+	if p.sem != nil {
+		<-p.sem
+	}
+}
+
+// sourceCheck invokes SourceCheck, through the cache if enabled.
+func (p *Listener) sourceCheck(addr net.Addr) (bool, error) {
+	p.init()
+	if p.cache == nil {
+		return p.SourceCheck(addr)
+	}
+	return p.cache.check(addr, p.SourceCheck)
+}
+
+// init lazily sets up the Listener's internal state.
+func (p *Listener) init() {
+	p.initOnce.Do(func() {
+		if p.SourceCheckCacheSize > 0 {
+			p.cache = newDecisionCache(p.SourceCheckCacheSize, p.SourceCheckCacheTTL)
+			if p.Clock != nil {
+				p.cache.now = p.Clock.Now
+			}
+		}
+		if p.MaxConns > 0 {
+			p.sem = make(chan struct{}, p.MaxConns)
+		}
+		if p.MaxConnsPerClientIP > 0 {
+			p.limiter = newClientLimiter(p.MaxConnsPerClientIP, p.ClientKey)
+		}
+		p.done = make(chan struct{})
+	})
+}
+
+// SetEnabled turns the handling of PROXY headers on or off for the
+// connections accepted from now on, for example while a load balancer
+// is being reconfigured. Listeners are enabled initially.
+func (p *Listener) SetEnabled(enabled bool) {
+	p.disabled.Store(!enabled)
+}
+
+// CacheStats returns statistics of the SourceCheck decision cache. It
+// is all zero if caching is disabled.
+func (p *Listener) CacheStats() CacheStats {
+	p.init()
+	if p.cache == nil {
+		return CacheStats{}
+	}
+	return p.cache.Stats()
+}
+
 // Close closes the underlying listener.
 func (p *Listener) Close() error {
-	return p.Listener.Close()
+	p.init()
+	p.closeOnce.Do(func() { close(p.done) })
+	l, _ := p.inner()
+	return l.Close()
 }
 
 // Addr returns the underlying listener's network address.
 func (p *Listener) Addr() net.Addr {
-	return p.Listener.Addr()
+	l, _ := p.inner()
+	return l.Addr()
 }
 
 // NewConn is used to wrap a net.Conn that may be speaking
@@ -112,23 +787,64 @@ func NewConn(conn net.Conn, timeout time.Duration) *Conn {
 		bufReader:          bufio.NewReader(conn),
 		conn:               conn,
 		proxyHeaderTimeout: timeout,
+		id:                 lastConnID.Add(1),
 	}
 	return pConn
 }
 
+// source returns the reader the read buffer is filled from, which reads
+// bypassing the buffer use once it is drained.
+func (p *Conn) source() io.Reader {
+	if p.src == nil {
+		return p.conn
+	}
+	return p.src
+}
+
+// ID returns the identifier of the connection, unique within the
+// process and increasing in the order connections were wrapped. It
+// appears in the messages logged for the connection, to correlate them
+// with those of the application.
+func (p *Conn) ID() uint64 {
+	return p.id
+}
+
 // Read is check for the proxy protocol header when doing
 // the initial scan. If there is an error parsing the header,
-// it is returned and the socket is closed.
+// it is returned and the socket is closed. The error is then
+// returned by all later reads and writes.
 func (p *Conn) Read(b []byte) (int, error) {
-	var err error
-	p.once.Do(func() { err = p.checkPrefix() })
-	if err != nil {
+	p.once.Do(func() { p.checkPrefix() })
+	if err := p.headerError(); err != nil {
+		return 0, err
+	}
+	if err := p.checkPendingDuplicate(); err != nil {
 		return 0, err
 	}
-	return p.bufReader.Read(b)
+
+	// Once the buffer is drained, bypass it to avoid copying. The buffer
+	// is shared by concurrent readers, but the socket is not locked so
+	// that a blocked Read does not hold up the others.
+	var n int
+	var err error
+	p.readMu.Lock()
+	if p.bufReader.Buffered() == 0 {
+		p.readMu.Unlock()
+		n, err = p.source().Read(b)
+	} else {
+		n, err = p.bufReader.Read(b)
+		p.readMu.Unlock()
+	}
+	if n > 0 && p.staleTimer != nil {
+		p.received.Store(true)
+	}
+	return n, err
 }
 
 func (p *Conn) ReadFrom(r io.Reader) (int64, error) {
+	if err := p.headerError(); err != nil {
+		return 0, err
+	}
 	if rf, ok := p.conn.(io.ReaderFrom); ok {
 		return rf.ReadFrom(r)
 	}
@@ -136,26 +852,60 @@ func (p *Conn) ReadFrom(r io.Reader) (int64, error) {
 }
 
 func (p *Conn) WriteTo(w io.Writer) (int64, error) {
-	var err error
-	p.once.Do(func() { err = p.checkPrefix() })
-	if err != nil {
+	p.once.Do(func() { p.checkPrefix() })
+	if err := p.headerError(); err != nil {
 		return 0, err
 	}
+	if err := p.checkPendingDuplicate(); err != nil {
+		return 0, err
+	}
+	if p.staleTimer != nil {
+		p.staleTimer.Stop()
+	}
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
 	return p.bufReader.WriteTo(w)
 }
 
 func (p *Conn) Write(b []byte) (int, error) {
+	if p.headerOnWrite {
+		p.once.Do(func() { p.checkPrefix() })
+	}
+	// A peer closing without sending anything may still be written to
+	if err := p.headerError(); err != nil && err != io.EOF {
+		return 0, err
+	}
 	return p.conn.Write(b)
 }
 
 func (p *Conn) Close() error {
+	p.closeOnce.Do(func() {
+		if p.staleTimer != nil {
+			p.staleTimer.Stop()
+		}
+		if p.onClose != nil {
+			p.onClose()
+		}
+		if p.callbacks != nil && p.callbacks.OnClose != nil {
+			p.callbacks.OnClose(p)
+		}
+		if p.limiter != nil {
+			p.mu.Lock()
+			p.closed = true
+			key := p.limitKey
+			p.mu.Unlock()
+			p.limiter.release(key)
+		}
+	})
 	return p.conn.Close()
 }
 
 func (p *Conn) LocalAddr() net.Addr {
-	p.checkPrefixOnce()
-	if p.dstAddr != nil && !p.useConnAddr {
-		return p.dstAddr
+	if !p.deferHeader {
+		p.checkPrefixOnce()
+	}
+	if h := p.addrHeader(); h != nil && h.DstAddr != nil {
+		return h.DstAddr
 	}
 	return p.conn.LocalAddr()
 }
@@ -164,17 +914,97 @@ func (p *Conn) LocalAddr() net.Addr {
 // protocol is being used, otherwise just returns the address of
 // the socket peer. If there is an error parsing the header, the
 // address of the client is not returned, and the socket is closed.
-// Once implication of this is that the call could block if the
+// With KeepRemoteAddr, the address of the socket peer is always
+// returned. Once implication of this is that the call could block if the
 // client is slow. Using a Deadline is recommended if this is called
-// before Read()
+// before Read(), unless the header is deferred.
 func (p *Conn) RemoteAddr() net.Addr {
-	p.checkPrefixOnce()
-	if p.srcAddr != nil && !p.useConnAddr {
-		return p.srcAddr
+	if !p.deferHeader {
+		p.checkPrefixOnce()
+	}
+	if p.keepRemoteAddr {
+		return p.conn.RemoteAddr()
+	}
+	if h := p.addrHeader(); h != nil && h.SrcAddr != nil {
+		if p.headerInAddr {
+			return &Addr{Addr: h.SrcAddr, Header: h}
+		}
+		return h.SrcAddr
 	}
 	return p.conn.RemoteAddr()
 }
 
+// OriginalDestination returns the address the client connected to: the
+// destination address of the header if one is used as for LocalAddr,
+// otherwise the address read with SO_ORIGINAL_DST if
+// OriginalDstFallback is set, or else the local address of the socket.
+// The SO_ORIGINAL_DST lookup fails if the connection was not
+// redirected, and returns ErrUnsupported on other platforms than Linux.
+// Like RemoteAddr, it blocks until the header has been read unless the
+// header is deferred.
+func (p *Conn) OriginalDestination() (net.Addr, error) {
+	if !p.deferHeader {
+		p.checkPrefixOnce()
+	}
+	if h := p.addrHeader(); h != nil && h.DstAddr != nil {
+		return h.DstAddr, nil
+	}
+	if p.origDstFallback {
+		return p.socketOriginalDst()
+	}
+	return p.conn.LocalAddr(), nil
+}
+
+// PolicyDecision returns how the connection's header is treated
+// according to SourceCheck, so that middleware can, for example, rate
+// limit untrusted direct connections differently. It is PolicyNone if
+// no SourceCheck is configured, and PolicyIgnore for connections
+// accepted while the Listener is disabled with SetEnabled. With a
+// SourceCheck set by WithSourceCheck rather than on the Listener, it
+// blocks until the header has been read, like RemoteAddr, unless the
+// header is deferred.
+func (p *Conn) PolicyDecision() PolicyDecision {
+	if p.sourceCheck != nil && !p.deferHeader {
+		p.checkPrefixOnce()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.decision
+}
+
+// setDecision records the policy decision for a source that SourceCheck
+// trusts or not.
+func (p *Conn) setDecision(trusted bool) {
+	d := PolicyIgnore
+	if trusted {
+		d = PolicyUse
+		if p.requireHeader {
+			d = PolicyRequire
+		}
+	}
+	p.mu.Lock()
+	p.decision = d
+	p.mu.Unlock()
+}
+
+// RemoteAddrAsync calls fn from another goroutine with the address
+// returned by RemoteAddr once the header has been read, reading it in
+// the background if needed, so that the caller does not block on a slow
+// client. Reads on the connection wait for the header as usual.
+func (p *Conn) RemoteAddrAsync(fn func(net.Addr)) {
+	go func() {
+		p.checkPrefixOnce()
+		fn(p.RemoteAddr())
+	}()
+}
+
+// ProxyAddr returns the address of the socket peer, which is the proxy
+// when the protocol is being used, even though RemoteAddr returns the
+// address of the client. It does not block.
+func (p *Conn) ProxyAddr() net.Addr {
+	return p.conn.RemoteAddr()
+}
+
 func (p *Conn) SetDeadline(t time.Time) error {
 	return p.conn.SetDeadline(t)
 }
@@ -187,104 +1017,839 @@ func (p *Conn) SetWriteDeadline(t time.Time) error {
 	return p.conn.SetWriteDeadline(t)
 }
 
-func (p *Conn) checkPrefixOnce() {
+// ProxyHeader returns the header sent on the connection, or nil if
+// there was none. Like RemoteAddr, it blocks until the header has been
+// read unless the header is deferred. It is also nil if SourceCheck did
+// not trust the source, as anyone could have sent the header then, so
+// the TLV accessors, FromContext and ALPNRouter only see headers of
+// trusted sources. Without SourceCheck, all sources are trusted.
+func (p *Conn) ProxyHeader() *Header {
+	if !p.deferHeader {
+		p.checkPrefixOnce()
+	}
+	return p.trustedHeader()
+}
+
+// PeekApplicationData returns the first n bytes sent after the header
+// without consuming them, reading the header first if needed, so that
+// sniffers can tell protocols such as HTTP and TLS apart before handing
+// the connection on. It blocks until n bytes are received, and returns
+// fewer bytes with an error if the connection fails first or if n
+// exceeds the read buffer, as bufio.Reader.Peek does. The bytes are
+// only valid until the next read, and it must not be called
+// concurrently with Read.
+func (p *Conn) PeekApplicationData(n int) ([]byte, error) {
+	if err := p.checkPrefixOnce(); err != nil {
+		return nil, err
+	}
+	if err := p.checkPendingDuplicate(); err != nil {
+		return nil, err
+	}
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+	return p.bufReader.Peek(n)
+}
+
+// DetachHeader returns the header of the connection like ProxyHeader,
+// to be attached with AttachHeader to a connection replacing this one,
+// as when a wrapping layer hands on the underlying net.Conn. It returns
+// nil if SourceCheck did not trust the source, as AttachHeader trusts
+// the header it is given.
+func (p *Conn) DetachHeader() *Header {
+	if !p.deferHeader {
+		p.checkPrefixOnce()
+	}
+	return p.trustedHeader()
+}
+
+// HeaderChain returns the headers read when MaxChainedHeaders is set,
+// in the order they were received, so the last one is the header
+// returned by ProxyHeader. It blocks like ProxyHeader and returns nil
+// if no header was received.
+func (p *Conn) HeaderChain() []*Header {
+	h := p.ProxyHeader()
+	if h == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.chain != nil {
+		return p.chain
+	}
+	return []*Header{h}
+}
+
+// TLVs returns the TLVs of the version 2 header sent on the
+// connection, if any. It blocks like ProxyHeader, and like it ignores
+// the header of an untrusted source.
+func (p *Conn) TLVs() []TLV {
+	if h := p.ProxyHeader(); h != nil {
+		return h.TLVs
+	}
+	return nil
+}
+
+// NetNS returns the network namespace of the client, from the NETNS
+// TLV sent by some service meshes. It blocks like ProxyHeader.
+func (p *Conn) NetNS() (string, bool) {
+	return p.tlvString(TLVTypeNetNS)
+}
+
+// ALPN returns the application protocol negotiated by the proxy with
+// the client, such as "h2", from the ALPN TLV. It blocks like
+// ProxyHeader.
+func (p *Conn) ALPN() (string, bool) {
+	return p.tlvString(TLVTypeALPN)
+}
+
+// Authority returns the host name sent by the client, usually with TLS
+// SNI, from the authority TLV. It blocks like ProxyHeader.
+func (p *Conn) Authority() (string, bool) {
+	return p.tlvString(TLVTypeAuthority)
+}
+
+// tlvString returns the value of the first TLV of the given type.
+func (p *Conn) tlvString(typ byte) (string, bool) {
+	for _, tlv := range p.TLVs() {
+		if tlv.Type == typ {
+			return string(tlv.Value), true
+		}
+	}
+	return "", false
+}
+
+// NetConn returns the underlying connection that is wrapped by p.
+// Reading from it directly bypasses the header handling and any data
+// already buffered by p.
+func (p *Conn) NetConn() net.Conn {
+	return p.conn
+}
+
+// HeaderReadDuration returns how long it took to read the proxy header,
+// or to determine that there is none. It is zero until the header has
+// been read.
+func (p *Conn) HeaderReadDuration() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.headerReadDuration
+}
+
+// HeaderBytes returns the number of bytes consumed by the proxy header,
+// for traffic accounting. It is zero if there was no header or it has
+// not been read yet.
+func (p *Conn) HeaderBytes() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.headerLen
+}
+
+// remainingHeaderBytes returns how many more header bytes may be read
+// under MaxHeaderBytes.
+func (p *Conn) remainingHeaderBytes() int {
+	if p.maxHeaderBytes <= 0 {
+		return math.MaxInt
+	}
+	return p.maxHeaderBytes - p.HeaderBytes()
+}
+
+// addHeaderLen records n bytes consumed by the header.
+func (p *Conn) addHeaderLen(n int) {
+	p.mu.Lock()
+	p.headerLen += n
+	p.mu.Unlock()
+}
+
+// SetKeepAlive sets whether the operating system should send keep-alive
+// messages on the underlying connection. It returns ErrUnsupported if
+// the underlying connection is not a *net.TCPConn.
+func (p *Conn) SetKeepAlive(keepalive bool) error {
+	if tc, ok := p.conn.(*net.TCPConn); ok {
+		return tc.SetKeepAlive(keepalive)
+	}
+	return ErrUnsupported
+}
+
+// SetKeepAlivePeriod sets the period between keep-alives on the
+// underlying connection. It returns ErrUnsupported if the underlying
+// connection is not a *net.TCPConn.
+func (p *Conn) SetKeepAlivePeriod(d time.Duration) error {
+	if tc, ok := p.conn.(*net.TCPConn); ok {
+		return tc.SetKeepAlivePeriod(d)
+	}
+	return ErrUnsupported
+}
+
+// SetNoDelay controls Nagle's algorithm on the underlying connection.
+// It returns ErrUnsupported if the underlying connection is not a
+// *net.TCPConn.
+func (p *Conn) SetNoDelay(noDelay bool) error {
+	if tc, ok := p.conn.(*net.TCPConn); ok {
+		return tc.SetNoDelay(noDelay)
+	}
+	return ErrUnsupported
+}
+
+// SetLinger sets the behavior of Close on the underlying connection, as
+// with net.TCPConn.SetLinger. It returns ErrUnsupported if the
+// underlying connection is not a *net.TCPConn.
+func (p *Conn) SetLinger(sec int) error {
+	if tc, ok := p.conn.(*net.TCPConn); ok {
+		return tc.SetLinger(sec)
+	}
+	return ErrUnsupported
+}
+
+// reject closes a connection refused by policy, resetting it if
+// RejectWithRST is set.
+func (p *Conn) reject() {
+	if p.rejectWithRST {
+		setLingerZero(p.conn)
+	}
+	p.conn.Close()
+}
+
+// setLingerZero makes closing conn send a reset, if it supports it.
+func setLingerZero(conn net.Conn) {
+	if lc, ok := conn.(interface{ SetLinger(int) error }); ok {
+		lc.SetLinger(0)
+	}
+}
+
+// SetReadBuffer sets the size of the operating system's receive buffer
+// of the underlying connection. It returns ErrUnsupported if the
+// underlying connection does not have one, as net.Pipe connections.
+func (p *Conn) SetReadBuffer(bytes int) error {
+	if bc, ok := p.conn.(interface{ SetReadBuffer(int) error }); ok {
+		return bc.SetReadBuffer(bytes)
+	}
+	return ErrUnsupported
+}
+
+// SetWriteBuffer sets the size of the operating system's transmit
+// buffer of the underlying connection. It returns ErrUnsupported if the
+// underlying connection does not have one.
+func (p *Conn) SetWriteBuffer(bytes int) error {
+	if bc, ok := p.conn.(interface{ SetWriteBuffer(int) error }); ok {
+		return bc.SetWriteBuffer(bytes)
+	}
+	return ErrUnsupported
+}
+
+// SyscallConn returns a raw network connection of the underlying
+// connection, so socket options can be set after wrapping. It returns
+// ErrUnsupported if the underlying connection does not implement
+// syscall.Conn.
+func (p *Conn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := p.conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, ErrUnsupported
+}
+
+// Control calls fn with the file descriptor, or handle on Windows, of
+// the underlying socket, as with syscall.RawConn.Control, looking
+// through connections wrapping it with a NetConn method, such as
+// *tls.Conn. It returns ErrUnsupported if no socket is found.
+func (p *Conn) Control(fn func(fd uintptr)) error {
+	conn := p.conn
+	for {
+		if sc, ok := conn.(syscall.Conn); ok {
+			raw, err := sc.SyscallConn()
+			if err != nil {
+				return err
+			}
+			return raw.Control(fn)
+		}
+		nc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return ErrUnsupported
+		}
+		conn = nc.NetConn()
+	}
+}
+
+// File returns a copy of the underlying connection's file descriptor,
+// as with net.TCPConn.File. It returns ErrUnsupported if the underlying
+// connection does not expose a file.
+func (p *Conn) File() (*os.File, error) {
+	if fc, ok := p.conn.(interface{ File() (*os.File, error) }); ok {
+		return fc.File()
+	}
+	return nil, ErrUnsupported
+}
+
+// checkPrefixOnce reads the header if that was not done yet, returning
+// the error that failed reading it, if any.
+func (p *Conn) checkPrefixOnce() error {
 	p.once.Do(func() {
-		if err := p.checkPrefix(); err != nil && err != io.EOF {
-			log.Printf("[ERR] Failed to read proxy prefix: %v", err)
+		// Connections without a required header are left open for the
+		// reply written by WriteGreeting
+		err := p.checkPrefix()
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, ErrHeaderRequired) {
+			log.Printf("[ERR] Failed to read proxy prefix of conn %d: %v", p.id, err)
 			p.Close()
-			p.bufReader = bufio.NewReader(p.conn)
 		}
 	})
+	return p.headerError()
 }
 
-func (p *Conn) checkPrefix() error {
-	if p.proxyHeaderTimeout != 0 {
-		readDeadLine := time.Now().Add(p.proxyHeaderTimeout)
-		p.conn.SetReadDeadline(readDeadLine)
-		defer p.conn.SetReadDeadline(time.Time{})
+// headerError returns the error that failed reading the header. It is
+// sticky, returned by all reads and writes once the header failed, so
+// that they do not see the remains of a malformed header.
+func (p *Conn) headerError() error {
+	if !p.failed.Load() {
+		return nil
 	}
+	return p.headerErr
+}
+
+func (p *Conn) checkPrefix() (err error) {
+	start := p.now()
+	defer func() {
+		p.mu.Lock()
+		p.headerReadDuration = p.now().Sub(start)
+		p.mu.Unlock()
+		if err != nil {
+			p.headerErr = err
+			p.failed.Store(true)
+		}
+	}()
 
-	// Incrementally check each byte of the prefix
-	for i := 1; i <= prefixLen; i++ {
-		inp, err := p.bufReader.Peek(i)
+	err = p.readHeader()
+	if err != nil {
+		p.trace.error(err)
+	} else if p.adaptive != nil && p.HeaderBytes() > 0 {
+		p.adaptive.Observe(p.now().Sub(start))
+	}
+	p.trace.done(p, start, p.proxyHeader(), err)
+	if p.bufReader.Buffered() > 0 || p.HeaderBytes() > 0 {
+		p.received.Store(true)
+	}
+	if p.metrics != nil {
+		p.metrics.record(p, err)
+	}
+	if err == ErrConnectionClosedBeforeHeader {
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	if err := p.limitClient(); err != nil {
+		return err
+	}
+	if p.callbacks != nil && p.callbacks.OnHeader != nil {
+		p.callbacks.OnHeader(p, p.proxyHeader())
+	}
+	return nil
+}
 
+// readHeader checks the source and reads the header, if any.
+func (p *Conn) readHeader() error {
+	if p.sourceCheck != nil {
+		allowed, err := p.sourceCheck(p.conn.RemoteAddr())
 		if err != nil {
-			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				return nil
-			} else {
-				return err
-			}
+			p.reject()
+			return err
 		}
+		if !allowed {
+			p.mu.Lock()
+			p.useConnAddr = true
+			p.mu.Unlock()
+		}
+		p.setDecision(allowed)
+	}
+	if p.skipUntrusted && p.useConnAddr {
+		return nil
+	}
+	if p.timeoutFor != nil {
+		p.proxyHeaderTimeout = p.timeoutFor(p.conn.RemoteAddr(), !p.useConnAddr)
+	} else if p.adaptive != nil {
+		if d, ok := p.adaptive.Timeout(); ok {
+			p.proxyHeaderTimeout = d
+		}
+	}
 
-		// Check for a prefix mis-match, quit early
-		if !bytes.Equal(inp, prefix[:i]) {
-			return nil
+	if p.proxyHeaderTimeout != 0 {
+		defer p.setHeaderDeadline()()
+	}
+
+	version, err := p.peekSignature()
+	p.trace.signatureDetected(version)
+	if err == io.EOF && p.bufReader.Buffered() == 0 {
+		return ErrConnectionClosedBeforeHeader
+	}
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		if p.requireHeader && !p.useConnAddr {
+			return ErrHeaderRequired
 		}
+		return nil
+	}
+	h, err := p.readVersion(version)
+	if err != nil || h == nil {
+		return err
 	}
 
-	// Read the header line
-	header, err := p.bufReader.ReadString('\n')
+	// Headers of chained proxies follow the first one
+	chain := []*Header{h}
+	for len(chain) < p.maxChained {
+		version, err := p.peekSignature()
+		if err != nil && err != io.EOF {
+			p.conn.Close()
+			return err
+		}
+		if version == 0 {
+			break
+		}
+		p.trace.signatureDetected(version)
+		next, err := p.readVersion(version)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			break
+		}
+		h = next
+		chain = append(chain, h)
+	}
+	if len(chain) > 1 {
+		p.mu.Lock()
+		p.chain = chain
+		p.mu.Unlock()
+	}
+	return p.setHeader(h)
+}
+
+// readVersion reads and verifies a header of the given version, which
+// was found at the start of the buffered stream. It returns a nil header
+// and error when FallbackOnError is set and the header is malformed.
+func (p *Conn) readVersion(version int) (*Header, error) {
+	p.lastVersion = version
+	if !p.versionAllowed(version) {
+		p.reject()
+		return nil, ErrVersionNotAllowed
+	}
+
+	var h *Header
+	var err error
+	before := p.HeaderBytes()
+	if version == 1 {
+		h, err = p.readV1()
+	} else {
+		h, err = p.readV2()
+	}
 	if err != nil {
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			p.conn.Close()
+			return nil, &HeaderTimeoutError{Err: err}
+		}
+		if p.fallbackOnError {
+			// The header was not consumed, so it is read as data and
+			// not counted
+			p.mu.Lock()
+			p.headerLen = before
+			p.mu.Unlock()
+			log.Printf("[WARN] Treating malformed proxy header of conn %d as data: %v", p.id, err)
+			return nil, nil
+		}
+		if p.debugBytes > 0 {
+			err = &HeaderDumpError{Err: err, Data: p.head(p.debugBytes)}
+		}
 		p.conn.Close()
-		return err
+		return nil, err
+	}
+	p.trace.headerParsed(h)
+	if p.verifyHeader != nil {
+		if err := p.verifyHeader(h); err != nil {
+			p.rejected = true
+			p.reject()
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// versionAllowed checks the version against the allowed versions.
+func (p *Conn) versionAllowed(version int) bool {
+	if len(p.allowedVersions) == 0 {
+		return true
+	}
+	for _, v := range p.allowedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// readV1 reads and parses a human-readable version 1 header.
+func (p *Conn) readV1() (*Header, error) {
+	maxLen := v1MaxLen
+	if p.lenientV1 {
+		maxLen = v1LenientMaxLen
+	}
+
+	// Peek the header line, consuming it only once it is valid
+	limited := false
+	if remaining := p.remainingHeaderBytes(); remaining < maxLen {
+		maxLen, limited = remaining, true
+	}
+	header, err := p.peekLine(maxLen)
+	if err != nil {
+		if buf, _ := p.bufReader.Peek(maxLen); limited && len(buf) == maxLen {
+			return nil, ErrHeaderTooLarge
+		}
+		return nil, err
+	}
+	p.addHeaderLen(len(header))
+	p.trace.bytesRead([]byte(header))
+	h, err := parseV1(header, v1Options{
+		lenient:       p.lenientV1,
+		lenientSyntax: p.lenientV1Syntax,
+		strict:        p.strictV1,
+		unknownOK:     p.unknownOK,
+	})
+	if err != nil {
+		return nil, err
 	}
+	p.bufReader.Discard(len(header))
+	return h, nil
+}
+
+// v1Options are the options of parseV1, matching the Listener fields
+// of the same name.
+type v1Options struct {
+	lenient       bool
+	lenientSyntax bool
+	strict        bool
+	unknownOK     bool
+}
 
+// parseV1 parses a version 1 header line, including its CRLF.
+func parseV1(header string, opts v1Options) (*Header, error) {
 	// Strip the carriage return and new line
-	header = header[:len(header)-2]
+	switch {
+	case strings.HasSuffix(header, "\r\n"):
+		header = header[:len(header)-2]
+	case opts.lenientSyntax && strings.HasSuffix(header, "\n"):
+		header = header[:len(header)-1]
+	default:
+		return nil, fmt.Errorf("Invalid header line ending: %q", header)
+	}
+	if opts.lenientSyntax {
+		header = strings.ToUpper(header)
+	}
+
+	// Legacy appliances send trailing data after UNKNOWN
+	if opts.lenient && (header == v1Unknown || strings.HasPrefix(header, v1Unknown+" ")) {
+		return &Header{Version: 1, Command: "PROXY", Protocol: "UNKNOWN"}, nil
+	}
+	if len(header)+2 > v1MaxLen {
+		return nil, fmt.Errorf("Header line exceeds %d bytes", v1MaxLen)
+	}
+
+	// Only printable ASCII is valid in the header line
+	for i := 0; i < len(header); i++ {
+		if header[i] < 0x20 || header[i] > 0x7e {
+			return nil, fmt.Errorf("Invalid character in header line: %q", header)
+		}
+	}
 
 	// Split on spaces, should be (PROXY <type> <src addr> <dst addr> <src port> <dst port>)
 	parts := strings.Split(header, " ")
 	if len(parts) < 2 {
-		p.conn.Close()
-		return fmt.Errorf("Invalid header line: %s", header)
+		return nil, fmt.Errorf("Invalid header line: %s", header)
 	}
 
+	h := &Header{Version: 1, Command: "PROXY", Protocol: parts[1]}
+
 	// Verify the type is known
 	switch parts[1] {
 	case "UNKNOWN":
-		if !p.unknownOK || len(parts) != 2 {
-			p.conn.Close()
-			return fmt.Errorf("Invalid UNKNOWN header line: %s", header)
+		if !opts.unknownOK || len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid UNKNOWN header line: %s", header)
 		}
-		p.useConnAddr = true
-		return nil
+		return h, nil
 	case "TCP4":
 	case "TCP6":
 	default:
-		p.conn.Close()
-		return fmt.Errorf("Unhandled address type: %s", parts[1])
+		return nil, fmt.Errorf("Unhandled address type: %s", parts[1])
 	}
 
 	if len(parts) != 6 {
-		p.conn.Close()
-		return fmt.Errorf("Invalid header line: %s", header)
+		return nil, fmt.Errorf("Invalid header line: %s", header)
 	}
 
 	// Parse out the source address
 	ip := net.ParseIP(parts[2])
 	if ip == nil {
-		p.conn.Close()
-		return fmt.Errorf("Invalid source ip: %s", parts[2])
+		return nil, fmt.Errorf("%w: source ip %s", ErrInvalidAddress, parts[2])
 	}
-	port, err := strconv.Atoi(parts[4])
+	if !v1FamilyMatches(parts[1], parts[2]) {
+		return nil, fmt.Errorf("%w: source ip %s", ErrAddressFamilyMismatch, parts[2])
+	}
+	port, err := parsePort(parts[4], opts.strict)
 	if err != nil {
-		p.conn.Close()
-		return fmt.Errorf("Invalid source port: %s", parts[4])
+		return nil, fmt.Errorf("%w: source port %s", ErrInvalidPort, parts[4])
 	}
-	p.srcAddr = &net.TCPAddr{IP: ip, Port: port}
+	h.SrcAddr = &net.TCPAddr{IP: ip, Port: port}
 
 	// Parse out the destination address
 	ip = net.ParseIP(parts[3])
 	if ip == nil {
-		p.conn.Close()
-		return fmt.Errorf("Invalid destination ip: %s", parts[3])
+		return nil, fmt.Errorf("%w: destination ip %s", ErrInvalidAddress, parts[3])
+	}
+	if !v1FamilyMatches(parts[1], parts[3]) {
+		return nil, fmt.Errorf("%w: destination ip %s", ErrAddressFamilyMismatch, parts[3])
 	}
-	port, err = strconv.Atoi(parts[5])
+	port, err = parsePort(parts[5], opts.strict)
 	if err != nil {
-		p.conn.Close()
-		return fmt.Errorf("Invalid destination port: %s", parts[5])
+		return nil, fmt.Errorf("%w: destination port %s", ErrInvalidPort, parts[5])
+	}
+	h.DstAddr = &net.TCPAddr{IP: ip, Port: port}
+
+	return h, nil
+}
+
+// v1FamilyMatches reports whether the textual address ip is of the
+// family of the TCP4 or TCP6 protocol token. IPv4-mapped IPv6 addresses
+// are IPv6 addresses.
+func v1FamilyMatches(protocol, ip string) bool {
+	if protocol == "TCP4" {
+		return !strings.Contains(ip, ":")
+	}
+	return strings.Contains(ip, ":")
+}
+
+// parsePort parses a decimal port number in the range 0-65535.
+func parsePort(s string, strict bool) (int, error) {
+	if strict && len(s) > 1 && s[0] == '0' {
+		return 0, ErrInvalidPort
+	}
+	port, err := strconv.ParseUint(s, 10, 16)
+	return int(port), err
+}
+
+// peekLine returns the buffered data up to and including the next
+// newline without consuming it, failing if the line is longer than max
+// bytes.
+func (p *Conn) peekLine(max int) (string, error) {
+	for i := 1; i <= max; i++ {
+		buf, err := p.bufReader.Peek(i)
+		if err != nil {
+			return "", err
+		}
+		if buf[i-1] == '\n' {
+			return string(buf), nil
+		}
+	}
+	return "", fmt.Errorf("Header line exceeds %d bytes", max)
+}
+
+// setHeader records a successfully parsed header, after checking for a
+// duplicate, and notifies the OnHeaderParsed callback.
+func (p *Conn) setHeader(h *Header) error {
+	if err := p.checkDuplicate(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.header = h
+	p.mu.Unlock()
+	if p.onHeaderParsed != nil {
+		p.onHeaderParsed(h)
+	}
+	return nil
+}
+
+// proxyHeader returns the parsed header, or nil if none has been parsed.
+func (p *Conn) proxyHeader() *Header {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.header
+}
+
+// trustedHeader returns the parsed header, or nil if none has been
+// parsed or SourceCheck did not trust the source.
+func (p *Conn) trustedHeader() *Header {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.useConnAddr {
+		return nil
+	}
+	return p.header
+}
+
+// addrHeader returns the parsed header if its addresses should be used
+// in place of the connection's, or nil otherwise.
+func (p *Conn) addrHeader() *Header {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.useConnAddr || p.header == nil {
+		return nil
+	}
+	if len(p.overrideFor) == 0 {
+		return p.header
+	}
+	for _, t := range p.overrideFor {
+		if Transport(p.header.Protocol) == t {
+			return p.header
+		}
 	}
-	p.dstAddr = &net.TCPAddr{IP: ip, Port: port}
+	return nil
+}
 
+// peekSignature checks whether the buffered stream starts with a
+// version 1 or version 2 signature without consuming any bytes, and
+// returns the version found, or zero if there is none. A read timeout
+// is treated as the signature being absent.
+func (p *Conn) peekSignature() (int, error) {
+	inp, err := p.peek(1)
+	if err != nil || inp == nil {
+		return 0, err
+	}
+
+	var sig []byte
+	var version int
+	switch {
+	case (inp[0] == prefix[0] || p.lenientV1Syntax && inp[0] == 'p') && p.detects(1):
+		sig, version = prefix, 1
+	case inp[0] == sigV2[0] && p.detects(2):
+		sig, version = sigV2, 2
+	default:
+		// Other data, such as a TLS ClientHello from a direct client,
+		// is decided on the first byte without waiting for more
+		return 0, nil
+	}
+
+	// Incrementally check each byte of the signature
+	for i := 2; i <= len(sig); i++ {
+		inp, err := p.peek(i)
+		if err == io.EOF {
+			// The stream ended inside the signature, so it is data
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// Check for a signature mis-match, quit early
+		if inp == nil || !sigMatches(inp, sig[:i], version == 1 && p.lenientV1Syntax) {
+			return 0, nil
+		}
+	}
+	return version, nil
+}
+
+// head returns a copy of up to n buffered bytes.
+func (p *Conn) head(n int) []byte {
+	if b := p.bufReader.Buffered(); n > b {
+		n = b
+	}
+	buf, _ := p.bufReader.Peek(n)
+	return append([]byte(nil), buf...)
+}
+
+// detects checks the version against the detected versions.
+func (p *Conn) detects(version int) bool {
+	if len(p.detectVersions) == 0 {
+		return true
+	}
+	for _, v := range p.detectVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// sigMatches compares b to a signature, ignoring case if fold is set.
+func sigMatches(b, sig []byte, fold bool) bool {
+	if fold {
+		return bytes.EqualFold(b, sig)
+	}
+	return bytes.Equal(b, sig)
+}
+
+// waitForData blocks until data arrives on the connection, without
+// reading the header, so that the wait can be cut short by a deadline
+// without failing the connection.
+func (p *Conn) waitForData() error {
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+	_, err := p.bufReader.Peek(1)
+	return err
+}
+
+// peek returns the next n bytes without advancing the reader. On a read
+// timeout, or if peekBuffered is set and fewer bytes are buffered, both
+// the returned slice and error are nil.
+func (p *Conn) peek(n int) ([]byte, error) {
+	if p.peekBuffered && n > p.bufReader.Buffered() {
+		return nil, nil
+	}
+	inp, err := p.bufReader.Peek(n)
+	if err != nil {
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			p.timedOut = true
+			return nil, nil
+		}
+		return nil, err
+	}
+	return inp, nil
+}
+
+// checkDuplicate rejects the connection if another PROXY header
+// follows the one that was just parsed.
+func (p *Conn) checkDuplicate() error {
+	if !p.rejectDuplicate {
+		return nil
+	}
+
+	// The client may only send more data after a reply, so only what
+	// was already received is inspected, leaving the rest to Read
+	p.peekBuffered = true
+	version, err := p.peekSignature()
+	p.peekBuffered = false
+	if err != nil && err != io.EOF {
+		p.conn.Close()
+		return err
+	}
+	if version != 0 {
+		p.conn.Close()
+		return ErrDuplicateHeader
+	}
+	p.dupPending = p.bufReader.Buffered() < len(sigV2)
 	return nil
 }
+
+// checkPendingDuplicate finishes checkDuplicate before the first bytes
+// after the header are read, waiting for as many as needed. It returns
+// ErrDuplicateHeader from then on if another header followed.
+func (p *Conn) checkPendingDuplicate() error {
+	if !p.dupPending {
+		return nil
+	}
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+	if p.dupDone {
+		return p.dupErr
+	}
+
+	// A read timeout leaves the check to the next read
+	timedOut := p.timedOut
+	p.timedOut = false
+	version, err := p.peekSignature()
+	if p.timedOut && err == nil && version == 0 {
+		p.timedOut = timedOut
+		return nil
+	}
+	p.timedOut = timedOut
+	p.dupDone = true
+	if version != 0 {
+		p.conn.Close()
+		p.dupErr = ErrDuplicateHeader
+	}
+	return p.dupErr
+}
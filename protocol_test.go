@@ -2,8 +2,11 @@ package proxyproto
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -29,7 +32,8 @@ func TestPassthrough(t *testing.T) {
 	go func() {
 		conn, err := net.Dial("tcp", pl.Addr().String())
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
@@ -37,10 +41,12 @@ func TestPassthrough(t *testing.T) {
 		recv := make([]byte, 4)
 		_, err = conn.Read(recv)
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		if !bytes.Equal(recv, []byte("pong")) {
-			t.Fatalf("bad: %v", recv)
+			t.Errorf("bad: %v", recv)
+			return
 		}
 	}()
 
@@ -77,7 +83,8 @@ func TestTimeout(t *testing.T) {
 	go func() {
 		conn, err := net.Dial("tcp", pl.Addr().String())
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
@@ -88,10 +95,12 @@ func TestTimeout(t *testing.T) {
 		recv := make([]byte, 4)
 		_, err = conn.Read(recv)
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		if !bytes.Equal(recv, []byte("pong")) {
-			t.Fatalf("bad: %v", recv)
+			t.Errorf("bad: %v", recv)
+			return
 		}
 	}()
 
@@ -139,7 +148,8 @@ func TestParse_ipv4(t *testing.T) {
 	go func() {
 		conn, err := net.Dial("tcp", pl.Addr().String())
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
@@ -151,10 +161,12 @@ func TestParse_ipv4(t *testing.T) {
 		recv := make([]byte, 4)
 		_, err = conn.Read(recv)
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		if !bytes.Equal(recv, []byte("pong")) {
-			t.Fatalf("bad: %v", recv)
+			t.Errorf("bad: %v", recv)
+			return
 		}
 	}()
 
@@ -185,6 +197,10 @@ func TestParse_ipv4(t *testing.T) {
 	if addr.Port != 1000 {
 		t.Fatalf("bad: %v", addr)
 	}
+
+	if conn.(*Conn).HeaderReadDuration() <= 0 {
+		t.Fatalf("bad: %v", conn.(*Conn).HeaderReadDuration())
+	}
 }
 
 func TestParse_ipv6(t *testing.T) {
@@ -198,7 +214,8 @@ func TestParse_ipv6(t *testing.T) {
 	go func() {
 		conn, err := net.Dial("tcp", pl.Addr().String())
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
@@ -210,10 +227,12 @@ func TestParse_ipv6(t *testing.T) {
 		recv := make([]byte, 4)
 		_, err = conn.Read(recv)
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		if !bytes.Equal(recv, []byte("pong")) {
-			t.Fatalf("bad: %v", recv)
+			t.Errorf("bad: %v", recv)
+			return
 		}
 	}()
 
@@ -257,7 +276,8 @@ func TestParse_Unknown(t *testing.T) {
 	go func() {
 		conn, err := net.Dial("tcp", pl.Addr().String())
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
@@ -269,10 +289,12 @@ func TestParse_Unknown(t *testing.T) {
 		recv := make([]byte, 4)
 		_, err = conn.Read(recv)
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		if !bytes.Equal(recv, []byte("pong")) {
-			t.Fatalf("bad: %v", recv)
+			t.Errorf("bad: %v", recv)
+			return
 		}
 	}()
 
@@ -308,7 +330,8 @@ func TestParse_BadHeader(t *testing.T) {
 	go func() {
 		conn, err := net.Dial("tcp", pl.Addr().String())
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
@@ -321,7 +344,8 @@ func TestParse_BadHeader(t *testing.T) {
 		recv := make([]byte, 4)
 		_, err = conn.Read(recv)
 		if err == nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 	}()
 
@@ -373,7 +397,8 @@ func testParse_ipv4_checkfunc(t *testing.T) {
 	go func() {
 		conn, err := net.Dial("tcp", pl.Addr().String())
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
@@ -385,10 +410,12 @@ func testParse_ipv4_checkfunc(t *testing.T) {
 		recv := make([]byte, 4)
 		_, err = conn.Read(recv)
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		if !bytes.Equal(recv, []byte("pong")) {
-			t.Fatalf("bad: %v", recv)
+			t.Errorf("bad: %v", recv)
+			return
 		}
 	}()
 
@@ -483,3 +510,1214 @@ func TestCopyFromWrappedConnectionToWrappedConnection(t *testing.T) {
 	}
 
 }
+
+func TestParse_DuplicateHeader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l, RejectDuplicateHeader: true}
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// The proxy writes the real header, and the client behind it
+		// tries to spoof its address with a second one.
+		header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+		spoofed := "PROXY TCP4 6.6.6.6 20.2.2.2 1000 2000\r\n"
+		conn.Write([]byte(header + spoofed))
+
+		conn.Write([]byte("ping"))
+		recv := make([]byte, 4)
+		conn.Read(recv)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	recv := make([]byte, 4)
+	_, err = conn.Read(recv)
+	if err != ErrDuplicateHeader {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestParse_DuplicateHeaderOnWrite(t *testing.T) {
+	header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	spoofed := "PROXY TCP4 6.6.6.6 20.2.2.2 1000 2000\r\n"
+
+	// Write-first servers must not wait for the client to send more
+	// than the header, but still see a spoofed header sent with it
+	for _, input := range []string{header, header + spoofed} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(input))
+			client.Read(make([]byte, 5))
+		}()
+
+		conn := Wrap(server, WithReadHeaderOnWrite(), WithRejectDuplicateHeader())
+		done := make(chan error, 1)
+		go func() {
+			_, err := conn.Write([]byte("220\r\n"))
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if input == header && err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if input != header && err != ErrDuplicateHeader {
+				t.Fatalf("err: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("write blocked")
+		}
+		client.Close()
+		conn.Close()
+	}
+}
+
+func TestParse_DuplicateHeaderLater(t *testing.T) {
+	header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	spoofed := "PROXY TCP4 6.6.6.6 20.2.2.2 1000 2000\r\n"
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		client.Write([]byte(header))
+		client.Read(make([]byte, 5))
+		client.Write([]byte(spoofed))
+	}()
+
+	// Looking at the client address does not wait for data that a
+	// write-first server has not asked for yet
+	conn := Wrap(server, WithRejectDuplicateHeader())
+	done := make(chan net.Addr, 1)
+	go func() { done <- conn.RemoteAddr() }()
+	select {
+	case addr := <-done:
+		if addr.String() != "10.1.1.1:1000" {
+			t.Fatalf("bad: %v", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("RemoteAddr blocked")
+	}
+	if _, err := conn.Write([]byte("220\r\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A header sent later is still found before it is read as data
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Read(make([]byte, 4)); err != ErrDuplicateHeader {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestSyscallConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Close()
+	}()
+
+	inner, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn := NewConn(inner, 0)
+	defer conn.Close()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var called bool
+	if err := raw.Control(func(fd uintptr) { called = true }); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !called {
+		t.Fatalf("control function not called")
+	}
+
+	// A connection without syscall.Conn support
+	if _, err := NewConn(&testConn{}, 0).SyscallConn(); err != ErrUnsupported {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// netConnWrapper hides the syscall.Conn of the connection it wraps
+// behind a NetConn method, as *tls.Conn does.
+type netConnWrapper struct {
+	conn net.Conn
+	net.Conn
+}
+
+func (w netConnWrapper) NetConn() net.Conn {
+	return w.conn
+}
+
+func TestControl(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Close()
+	}()
+
+	inner, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer inner.Close()
+
+	conn := NewConn(netConnWrapper{conn: inner}, 0)
+	var called bool
+	if err := conn.Control(func(fd uintptr) { called = true }); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !called {
+		t.Fatalf("control function not called")
+	}
+
+	if err := NewConn(&testConn{}, 0).Control(func(uintptr) {}); err != ErrUnsupported {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Close()
+	}()
+
+	inner, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn := NewConn(inner, 0)
+	defer conn.Close()
+
+	f, err := conn.File()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f.Close()
+
+	if _, err := NewConn(&testConn{}, 0).File(); err != ErrUnsupported {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l, KeepAlivePeriod: time.Minute}
+	defer pl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Close()
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	pConn := conn.(*Conn)
+	if err := pConn.SetKeepAlive(true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := pConn.SetKeepAlivePeriod(30 * time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := NewConn(&testConn{}, 0).SetKeepAlive(true); err != ErrUnsupported {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSocketOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+	defer pl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Close()
+	}()
+
+	conn, err := pl.AcceptProxy()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetNoDelay(false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := conn.SetLinger(0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := conn.SetReadBuffer(64 << 10); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := conn.SetWriteBuffer(64 << 10); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	pipe := NewConn(server, 0)
+	if err := pipe.SetNoDelay(true); err != ErrUnsupported {
+		t.Fatalf("err: %v", err)
+	}
+	if err := pipe.SetLinger(0); err != ErrUnsupported {
+		t.Fatalf("err: %v", err)
+	}
+	if err := pipe.SetReadBuffer(1024); err != ErrUnsupported {
+		t.Fatalf("err: %v", err)
+	}
+	if err := pipe.SetWriteBuffer(1024); err != ErrUnsupported {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestParse_DeferHeader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var parsed *Header
+	pl := &Listener{
+		Listener:       l,
+		DeferHeader:    true,
+		OnHeaderParsed: func(h *Header) { parsed = h },
+	}
+
+	ready := make(chan struct{})
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// Wait until the server has checked the address
+		<-ready
+
+		header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+		conn.Write([]byte(header))
+		conn.Write([]byte("ping"))
+		recv := make([]byte, 4)
+		conn.Read(recv)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// No data has arrived yet, so this must not block
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+	if addr.IP.String() != "127.0.0.1" {
+		t.Fatalf("bad: %v", addr)
+	}
+	close(ready)
+
+	recv := make([]byte, 4)
+	_, err = conn.Read(recv)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(recv, []byte("ping")) {
+		t.Fatalf("bad: %v", recv)
+	}
+
+	addr = conn.RemoteAddr().(*net.TCPAddr)
+	if addr.IP.String() != "10.1.1.1" {
+		t.Fatalf("bad: %v", addr)
+	}
+	if parsed == nil || parsed.SrcAddr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", parsed)
+	}
+	conn.Write([]byte("pong"))
+}
+
+func TestParse_LongHeaderLine(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// Never terminate the header line
+		conn.Write([]byte("PROXY TCP4 " + strings.Repeat("1", 4096)))
+		recv := make([]byte, 4)
+		conn.Read(recv)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	recv := make([]byte, 4)
+	_, err = conn.Read(recv)
+	if err == nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAllowedVersions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l, AllowedVersions: []int{2}}
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+		conn.Write([]byte(header))
+		recv := make([]byte, 4)
+		conn.Read(recv)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	recv := make([]byte, 4)
+	_, err = conn.Read(recv)
+	if err != ErrVersionNotAllowed {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestParseV1_Malformed(t *testing.T) {
+	headers := []string{
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\n",
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\r\n",
+		"PROXY TCP4 10.1.1.1 20.2.2.2 -1 2000\r\n",
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 65536\r\n",
+		"PROXY TCP4 10.1.1.1\xc3\xa9 20.2.2.2 1000 2000\r\n",
+	}
+
+	for _, header := range headers {
+		conn := NewConn(&bufConn{r: bytes.NewReader([]byte(header + "ping"))}, 0)
+		if _, err := conn.Read(make([]byte, 4)); err == nil {
+			t.Fatalf("expected error for %q", header)
+		}
+	}
+}
+
+func TestParseV1_FamilyMismatch(t *testing.T) {
+	headers := []string{
+		"PROXY TCP4 ::1 ::2 1000 2000\r\n",
+		"PROXY TCP4 ::1 20.2.2.2 1000 2000\r\n",
+		"PROXY TCP4 10.1.1.1 ::2 1000 2000\r\n",
+		"PROXY TCP4 ::ffff:10.1.1.1 20.2.2.2 1000 2000\r\n",
+		"PROXY TCP6 10.1.1.1 20.2.2.2 1000 2000\r\n",
+		"PROXY TCP6 10.1.1.1 ffff::ffff 1000 2000\r\n",
+		"PROXY TCP6 ffff::ffff 20.2.2.2 1000 2000\r\n",
+	}
+
+	for _, header := range headers {
+		conn := NewConn(&bufConn{r: bytes.NewReader([]byte(header + "ping"))}, 0)
+		_, err := conn.Read(make([]byte, 4))
+		if !errors.Is(err, ErrAddressFamilyMismatch) {
+			t.Fatalf("err for %q: %v", header, err)
+		}
+	}
+
+	// IPv4-mapped addresses are IPv6 addresses
+	header := "PROXY TCP6 ::ffff:10.1.1.1 ::ffff:20.2.2.2 1000 2000\r\n"
+	conn := NewConn(&bufConn{r: bytes.NewReader([]byte(header + "ping"))}, 0)
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestParse_LenientV1(t *testing.T) {
+	header := "PROXY UNKNOWN ffff::ffff ffff::ffff 1000 2000 " + strings.Repeat("x", 150) + "\r\n"
+
+	// Rejected by default
+	conn := NewConn(&bufConn{r: bytes.NewReader([]byte(header + "ping"))}, 0)
+	conn.unknownOK = true
+	if _, err := conn.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	conn = Wrap(&bufConn{r: bytes.NewReader([]byte(header + "ping"))}, WithLenientV1())
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(recv, []byte("ping")) {
+		t.Fatalf("bad: %v", recv)
+	}
+	if h := conn.proxyHeader(); h == nil || h.Protocol != "UNKNOWN" {
+		t.Fatalf("bad: %v", h)
+	}
+
+	// Only UNKNOWN lines may be long
+	long := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000 " + strings.Repeat("x", 150) + "\r\n"
+	conn = Wrap(&bufConn{r: bytes.NewReader([]byte(long + "ping"))}, WithLenientV1())
+	if _, err := conn.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestParse_LenientV1Syntax(t *testing.T) {
+	headers := []string{
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\n",
+		"proxy tcp4 10.1.1.1 20.2.2.2 1000 2000\r\n",
+		"Proxy Tcp4 10.1.1.1 20.2.2.2 1000 2000\n",
+	}
+
+	for _, header := range headers {
+		conn := Wrap(&bufConn{r: bytes.NewReader([]byte(header + "ping"))}, WithLenientV1Syntax())
+		recv := make([]byte, 4)
+		if _, err := conn.Read(recv); err != nil {
+			t.Fatalf("err for %q: %v", header, err)
+		}
+		if !bytes.Equal(recv, []byte("ping")) {
+			t.Fatalf("bad: %v", recv)
+		}
+		h := conn.proxyHeader()
+		if h == nil || h.Protocol != "TCP4" || h.SrcAddr.String() != "10.1.1.1:1000" {
+			t.Fatalf("bad: %v", h)
+		}
+
+		var p HeaderParser
+		p.LenientV1Syntax = true
+		if _, done, err := p.Feed([]byte(header)); !done || err != nil || p.Header() == nil {
+			t.Fatalf("bad: %v %v", done, err)
+		}
+	}
+
+	// Lowercase data is not a header by default
+	input := "proxy tcp4 10.1.1.1 20.2.2.2 1000 2000\r\nping"
+	data, err := io.ReadAll(Wrap(&bufConn{r: bytes.NewReader([]byte(input))}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != input {
+		t.Fatalf("bad: %q", data)
+	}
+}
+
+func TestNetConn(t *testing.T) {
+	inner := &testConn{}
+	if conn := NewConn(inner, 0).NetConn(); conn != inner {
+		t.Fatalf("bad: %v", conn)
+	}
+}
+
+// sizeConn records the sizes of the buffers passed to Read.
+type sizeConn struct {
+	r        *bytes.Reader
+	sizes    []int
+	net.Conn // nil; crash on any unexpected use
+}
+
+func (c *sizeConn) Read(p []byte) (int, error) {
+	c.sizes = append(c.sizes, len(p))
+	return c.r.Read(p)
+}
+
+func TestRead_BypassBuffer(t *testing.T) {
+	inner := &sizeConn{r: bytes.NewReader([]byte("ping"))}
+	conn := NewConn(inner, 0)
+
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := conn.Read(recv); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The first read fills the buffer, the second goes straight through
+	if len(inner.sizes) != 2 || inner.sizes[1] != len(recv) {
+		t.Fatalf("bad: %v", inner.sizes)
+	}
+}
+
+func TestParse_ReadHeaderOnWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{
+		Listener:           l,
+		ProxyHeaderTimeout: 50 * time.Millisecond,
+		ReadHeaderOnWrite:  true,
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// An SMTP client waits for the banner before sending anything
+		conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+		recv := make([]byte, 14)
+		if _, err := io.ReadFull(conn, recv); err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Write([]byte("EHLO localhost\r\n"))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("220 localhost\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if h := conn.(*Conn).proxyHeader(); h == nil {
+		t.Fatalf("header not read before write")
+	}
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	recv := make([]byte, 16)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "EHLO localhost\r\n" {
+		t.Fatalf("bad: %q", recv)
+	}
+}
+
+func TestParse_ReadHeaderOnWrite_NoHeader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{
+		Listener:           l,
+		ProxyHeaderTimeout: 50 * time.Millisecond,
+		ReadHeaderOnWrite:  true,
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		recv := make([]byte, 14)
+		if _, err := io.ReadFull(conn, recv); err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		conn.Write([]byte("QUIT\r\n"))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Without a header, the banner is sent once the timeout expires
+	if _, err := conn.Write([]byte("220 localhost\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+	if addr.IP.String() != "127.0.0.1" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	recv := make([]byte, 6)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "QUIT\r\n" {
+		t.Fatalf("bad: %q", recv)
+	}
+}
+
+func TestParse_ReadHeaderOnAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{
+		Listener:           l,
+		ProxyHeaderTimeout: time.Second,
+		ReadHeaderOnAccept: true,
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// An FTP client waits for the greeting before sending anything
+		conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+		recv := make([]byte, 10)
+		io.ReadFull(conn, recv)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	if h := conn.(*Conn).proxyHeader(); h == nil || h.SrcAddr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", h)
+	}
+	if _, err := conn.Write([]byte("220 ready\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestParse_InvalidHeaderNotConsumed(t *testing.T) {
+	inputs := [][]byte{
+		[]byte("PROXY TCP4 what 20.2.2.2 1000 2000\r\nping"),
+		[]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\nping"),
+		append(v2Header(0x1, 0x11, make([]byte, 4)), "ping"...),
+		append(v2Header(0x7, 0x11, make([]byte, 12)), "ping"...),
+	}
+	for _, input := range inputs {
+		conn := NewConn(&bufConn{r: bytes.NewReader(input)}, 0)
+		if err := conn.readHeader(); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+
+		// The rejected header must still be buffered as it was sent
+		buf, _ := conn.bufReader.Peek(len(input))
+		if !bytes.Equal(buf, input) {
+			t.Fatalf("bad: %q", buf)
+		}
+	}
+}
+
+func TestParse_ChainedHeaders(t *testing.T) {
+	regional := "PROXY TCP4 30.3.3.3 40.4.4.4 3000 4000\r\n"
+	edge := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	input := []byte(regional + edge + "ping")
+
+	conn := Wrap(&bufConn{r: bytes.NewReader(input)}, WithMaxChainedHeaders(2))
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "ping" {
+		t.Fatalf("bad: %q", recv)
+	}
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+	chain := conn.HeaderChain()
+	if len(chain) != 2 || chain[0].SrcAddr.String() != "30.3.3.3:3000" || chain[1] != conn.ProxyHeader() {
+		t.Fatalf("bad: %v", chain)
+	}
+
+	// A single header is a chain of one
+	conn = Wrap(&bufConn{r: bytes.NewReader([]byte(edge + "ping"))}, WithMaxChainedHeaders(2))
+	if chain := conn.HeaderChain(); len(chain) != 1 || chain[0].SrcAddr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", chain)
+	}
+
+	// Without the option, the second header is application data
+	conn = Wrap(&bufConn{r: bytes.NewReader(input)})
+	recv = make([]byte, len(edge))
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != edge {
+		t.Fatalf("bad: %q", recv)
+	}
+
+	// Headers beyond the maximum are duplicates
+	input = []byte(regional + regional + edge + "ping")
+	conn = Wrap(&bufConn{r: bytes.NewReader(input)}, WithMaxChainedHeaders(2), WithRejectDuplicateHeader())
+	if _, err := conn.Read(recv); err != ErrDuplicateHeader {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestListener_SetEnabled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+	defer pl.Close()
+
+	header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	dial := func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Write([]byte(header))
+		conn.Close()
+	}
+
+	pl.SetEnabled(false)
+	dial()
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Fatalf("bad: %T", conn)
+	}
+	recv, _ := io.ReadAll(conn)
+	if string(recv) != header {
+		t.Fatalf("bad: %q", recv)
+	}
+	conn.Close()
+
+	dial()
+	pconn, err := pl.AcceptProxy()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	recv, _ = io.ReadAll(pconn)
+	if string(recv) != header || pconn.ProxyHeader() != nil {
+		t.Fatalf("bad: %q", recv)
+	}
+	pconn.Close()
+
+	pl.SetEnabled(true)
+	dial()
+	conn, err = pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestHeaderTimeoutFromAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{
+		Listener:                l,
+		ProxyHeaderTimeout:      50 * time.Millisecond,
+		HeaderTimeoutFromAccept: true,
+	}
+	defer pl.Close()
+
+	var clients []net.Conn
+	for _, header := range []string{
+		"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n",
+		"PROXY TCP4 ",
+	} {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(header))
+		clients = append(clients, conn)
+	}
+
+	// The header is read while the application is busy
+	conn, err := pl.AcceptProxy()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	// The incomplete header timed out before it was first used
+	conn, err = pl.AcceptProxy()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	clients[1].Write([]byte("10.1.1.1 20.2.2.2 1000 2000\r\n"))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFallbackOnError(t *testing.T) {
+	large := v2Header(0x1, 0x11, make([]byte, 5000))
+	large[12] = 0x2f
+	inputs := [][]byte{
+		[]byte("PROXY TCP4 10.1.1.1 bogus 1000 2000\r\nping"),
+		[]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000"),
+		append(v2Header(0x2, 0x11, make([]byte, 12)), "ping"...),
+		append(large, "ping"...),
+	}
+
+	for _, input := range inputs {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(input)
+			client.Close()
+		}()
+
+		conn := Wrap(server, WithFallbackOnError())
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(data, input) {
+			t.Fatalf("bad: %d bytes", len(data))
+		}
+		if h := conn.ProxyHeader(); h != nil {
+			t.Fatalf("bad: %v", h)
+		}
+		if addr := conn.RemoteAddr(); addr != server.RemoteAddr() {
+			t.Fatalf("bad: %v", addr)
+		}
+		if n := conn.HeaderBytes(); n != 0 {
+			t.Fatalf("bad: %d", n)
+		}
+	}
+}
+
+func TestSignaturePrefixReplay(t *testing.T) {
+	inputs := []string{
+		"P",
+		"PROX",
+		"PROXIMITY ALERT\r\n",
+		"PROXY",
+		"\r\n\r\n\x00\r\nQUI",
+		"\r\n\r\nhello",
+	}
+
+	for _, input := range inputs {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(input))
+			client.Close()
+		}()
+
+		conn := Wrap(server)
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("%q: err: %v", input, err)
+		}
+		if string(data) != input {
+			t.Fatalf("%q: bad: %q", input, data)
+		}
+	}
+
+	// Diverging data is delivered without waiting for more
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("PROXIMA"))
+	conn := Wrap(server)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf[:n]) != "PROXIMA" {
+		t.Fatalf("bad: %q", buf[:n])
+	}
+}
+
+func TestDetectVersions(t *testing.T) {
+	v1 := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	v2 := string(v2Header(0x1, 0x11, payload)) + "ping"
+
+	cases := []struct {
+		input  string
+		header bool
+	}{
+		{v1, false},
+		{v2, true},
+	}
+
+	for _, c := range cases {
+		conn := Wrap(&bufConn{r: bytes.NewReader([]byte(c.input))}, WithDetectVersions(2))
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if c.header {
+			if string(data) != "ping" || conn.ProxyHeader() == nil {
+				t.Fatalf("bad: %q", data)
+			}
+		} else if string(data) != c.input || conn.ProxyHeader() != nil {
+			t.Fatalf("bad: %q", data)
+		}
+	}
+}
+
+func TestDebugHeaderBytes(t *testing.T) {
+	input := []byte("PROXY TCP4 10.1.1.1 bogus 1000 2000\r\nping")
+	conn := Wrap(&bufConn{r: bytes.NewReader(input)}, WithDebugHeaderBytes(8))
+	_, err := conn.Read(make([]byte, 4))
+
+	var dumpErr *HeaderDumpError
+	if !errors.As(err, &dumpErr) {
+		t.Fatalf("err: %v", err)
+	}
+	if string(dumpErr.Data) != "PROXY TC" {
+		t.Fatalf("bad: %q", dumpErr.Data)
+	}
+	if !strings.Contains(err.Error(), "50 52 4f 58 59 20 54 43") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestPeekApplicationData(t *testing.T) {
+	input := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nGET / HTTP/1.1\r\n"
+	conn := Wrap(&bufConn{r: bytes.NewReader([]byte(input))})
+
+	peeked, err := conn.PeekApplicationData(4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(peeked) != "GET " {
+		t.Fatalf("bad: %q", peeked)
+	}
+	if h := conn.ProxyHeader(); h == nil {
+		t.Fatalf("expected header")
+	}
+
+	// Peeked data is still read
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("bad: %q", data)
+	}
+
+	conn = Wrap(&bufConn{r: bytes.NewReader([]byte("PROXY TCP4 bogus\r\n"))})
+	if _, err := conn.PeekApplicationData(1); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRejectWithRST(t *testing.T) {
+	for _, rst := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		pl := &Listener{Listener: l, AllowedVersions: []int{2}, RejectWithRST: rst}
+
+		errCh := make(chan error, 1)
+		go func() {
+			conn, err := net.Dial("tcp", pl.Addr().String())
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+			_, err = conn.Read(make([]byte, 1))
+			errCh <- err
+		}()
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != ErrVersionNotAllowed {
+			t.Fatalf("err: %v", err)
+		}
+		err = <-errCh
+		if rst && !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("expected reset: %v", err)
+		}
+		if !rst && err != io.EOF {
+			t.Fatalf("err: %v", err)
+		}
+		pl.Close()
+	}
+}
+
+func TestHeaderErrorSticky(t *testing.T) {
+	input := []byte("PROXY TCP4 what 20.2.2.2 1000 2000\r\nping")
+	conn := Wrap(&bufConn{r: bytes.NewReader(input)})
+
+	_, err := conn.Read(make([]byte, 4))
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err2 := conn.Read(make([]byte, 4)); err2 != err {
+			t.Fatalf("err: %v", err2)
+		}
+	}
+	if _, err2 := conn.Write([]byte("pong")); err2 != err {
+		t.Fatalf("err: %v", err2)
+	}
+	if _, err2 := conn.WriteTo(io.Discard); err2 != err {
+		t.Fatalf("err: %v", err2)
+	}
+	if _, err2 := conn.PeekApplicationData(4); err2 != err {
+		t.Fatalf("err: %v", err2)
+	}
+
+	// The error is sticky whichever call read the header first
+	conn = Wrap(&bufConn{r: bytes.NewReader(input)})
+	conn.ProxyHeader()
+	if _, err := conn.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestHeaderErrorSticky_EOF(t *testing.T) {
+	// A peer closing before sending anything reads as a clean EOF, and
+	// may still be written to
+	conn := Wrap(&bufConn{r: bytes.NewReader(nil)})
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Read(make([]byte, 4)); err != io.EOF {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if _, err := conn.WriteTo(io.Discard); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestParse_StrictV1(t *testing.T) {
+	cases := []struct {
+		header string
+		strict error
+		loose  error
+	}{
+		{"PROXY TCP4 10.1.1.1 20.2.2.2 0 65535\r\n", nil, nil},
+		{"PROXY TCP4 10.1.1.1 20.2.2.2 01000 2000\r\n", ErrInvalidPort, nil},
+		{"PROXY TCP4 10.1.1.1 20.2.2.2 1000 00\r\n", ErrInvalidPort, nil},
+		{"PROXY TCP4 10.1.1.1 20.2.2.2 1000 65536\r\n", ErrInvalidPort, ErrInvalidPort},
+		{"PROXY TCP4 10.1.1.1 20.2.2.2 +1000 2000\r\n", ErrInvalidPort, ErrInvalidPort},
+		{"PROXY TCP4 10.1.1.1 20.2.2.2 0x10 2000\r\n", ErrInvalidPort, ErrInvalidPort},
+		{"PROXY TCP4 010.1.1.1 20.2.2.2 1000 2000\r\n", ErrInvalidAddress, ErrInvalidAddress},
+		{"PROXY TCP6 fe80::1%eth0 ::1 1000 2000\r\n", ErrInvalidAddress, ErrInvalidAddress},
+	}
+
+	for _, c := range cases {
+		for _, strict := range []bool{true, false} {
+			expected := c.loose
+			var opts []Option
+			if strict {
+				expected = c.strict
+				opts = append(opts, WithStrictV1())
+			}
+			conn := Wrap(&bufConn{r: bytes.NewReader([]byte(c.header + "ping"))}, opts...)
+			_, err := conn.Read(make([]byte, 4))
+			if !errors.Is(err, expected) {
+				t.Fatalf("%q strict=%v: err: %v", c.header, strict, err)
+			}
+
+			p := HeaderParser{StrictV1: strict}
+			if _, _, err := p.Feed([]byte(c.header)); !errors.Is(err, expected) {
+				t.Fatalf("%q strict=%v: err: %v", c.header, strict, err)
+			}
+		}
+	}
+}
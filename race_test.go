@@ -0,0 +1,60 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentAccess exercises a connection from several goroutines
+// before the header is parsed, to be run with the race detector.
+func TestConcurrentAccess(t *testing.T) {
+	for _, opts := range [][]Option{
+		nil,
+		{WithDeferHeader()},
+		{WithFallbackOnError()},
+	} {
+		client, server := net.Pipe()
+		conn := Wrap(server, opts...)
+
+		go func() {
+			// Data sent with the header is read from the buffer
+			data := []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n")
+			for i := 0; i < 100; i++ {
+				data = append(data, "ping"...)
+			}
+			client.Write(data)
+			client.Close()
+		}()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, 3)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						if err != io.EOF {
+							t.Errorf("err: %v", err)
+						}
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				conn.RemoteAddr()
+				conn.LocalAddr()
+				conn.ProxyHeader()
+				conn.HeaderBytes()
+				conn.HeaderReadDuration()
+				conn.TLVs()
+				conn.Context()
+			}()
+		}
+		wg.Wait()
+		conn.Close()
+	}
+}
@@ -0,0 +1,108 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// regressionVector is the expected parse result of a header in
+// testdata/regression.
+type regressionVector struct {
+	Version  int    `json:"version"`
+	Command  string `json:"command"`
+	Protocol string `json:"protocol"`
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	TLVs     []struct {
+		Type  byte   `json:"type"`
+		Value string `json:"value"`
+	} `json:"tlvs"`
+}
+
+// readHexFile decodes a hex file, skipping comments and whitespace.
+func readHexFile(t *testing.T, path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var digits strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		digits.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+	b, err := hex.DecodeString(digits.String())
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return b
+}
+
+func TestRegressionVectors(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "regression", "*.hex"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no vectors")
+	}
+
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".hex")
+		t.Run(name, func(t *testing.T) {
+			input := readHexFile(t, path)
+			data, err := os.ReadFile(strings.TrimSuffix(path, ".hex") + ".json")
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			var expected regressionVector
+			if err := json.Unmarshal(data, &expected); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			h := parseBytes(t, input)
+			if h == nil {
+				t.Fatalf("no header")
+			}
+			if h.Version != expected.Version || h.Command != expected.Command || h.Protocol != expected.Protocol {
+				t.Fatalf("bad: %d %s %s", h.Version, h.Command, h.Protocol)
+			}
+			if addrString(h.SrcAddr) != expected.Src || addrString(h.DstAddr) != expected.Dst {
+				t.Fatalf("bad: %v %v", h.SrcAddr, h.DstAddr)
+			}
+			if len(h.TLVs) != len(expected.TLVs) {
+				t.Fatalf("bad: %v", h.TLVs)
+			}
+			for i, tlv := range expected.TLVs {
+				value, _ := hex.DecodeString(tlv.Value)
+				if h.TLVs[i].Type != tlv.Type || !bytes.Equal(h.TLVs[i].Value, value) {
+					t.Fatalf("bad: %v", h.TLVs[i])
+				}
+			}
+
+			// Formatting the header again must reproduce the input
+			out, err := h.Format()
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !bytes.Equal(out, input) {
+				t.Fatalf("bad: %x", out)
+			}
+		})
+	}
+}
+
+// addrString returns the address as a string, or "" if it is nil.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,35 @@
+package proxyproto
+
+import "net"
+
+// ALPNRouter dispatches connections to handlers by the application
+// protocol the proxy negotiated with the client, so that backends do not
+// have to sniff the protocol themselves.
+type ALPNRouter struct {
+	// Handlers maps protocols, such as "h2" or "http/1.1", to the
+	// handler of their connections.
+	Handlers map[string]func(net.Conn)
+
+	// Default handles connections without an ALPN TLV or with a
+	// protocol missing from Handlers. If nil, they are closed.
+	Default func(net.Conn)
+}
+
+// Route calls the handler of conn, which is read from if needed to get
+// its header. Connections other than *Conn, and those from sources
+// SourceCheck does not trust, go to Default.
+func (r *ALPNRouter) Route(conn net.Conn) {
+	if pConn, ok := conn.(*Conn); ok {
+		if proto, ok := pConn.ALPN(); ok {
+			if handler, ok := r.Handlers[proto]; ok {
+				handler(conn)
+				return
+			}
+		}
+	}
+	if r.Default != nil {
+		r.Default(conn)
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,75 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestALPNRouter(t *testing.T) {
+	src := netip.MustParseAddrPort("10.1.1.1:1000")
+	dst := netip.MustParseAddrPort("20.2.2.2:2000")
+
+	var routed string
+	r := &ALPNRouter{
+		Handlers: map[string]func(net.Conn){
+			"h2":       func(net.Conn) { routed = "h2" },
+			"http/1.1": func(net.Conn) { routed = "http/1.1" },
+		},
+		Default: func(net.Conn) { routed = "default" },
+	}
+
+	cases := []struct {
+		header *Header
+		routed string
+	}{
+		{NewHeaderV2(src, dst).WithALPN("h2"), "h2"},
+		{NewHeaderV2(src, dst).WithALPN("http/1.1"), "http/1.1"},
+		{NewHeaderV2(src, dst).WithALPN("smtp"), "default"},
+		{NewHeaderV2(src, dst), "default"},
+		{NewHeaderV1(src, dst), "default"},
+	}
+
+	for _, c := range cases {
+		buf, err := c.header.Format()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		r.Route(Wrap(&bufConn{r: bytes.NewReader(buf)}))
+		if routed != c.routed {
+			t.Fatalf("bad: %v %v", c.header, routed)
+		}
+	}
+}
+
+func TestALPNRouter_Untrusted(t *testing.T) {
+	src := netip.MustParseAddrPort("10.1.1.1:1000")
+	dst := netip.MustParseAddrPort("20.2.2.2:2000")
+	buf, err := NewHeaderV2(src, dst).WithALPN("h2").Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write(buf)
+
+	// The header of an untrusted source is not used for routing
+	conn := Wrap(server, WithSourceCheck(func(net.Addr) (bool, error) { return false, nil }))
+	var routed string
+	r := &ALPNRouter{
+		Handlers: map[string]func(net.Conn){"h2": func(net.Conn) { routed = "h2" }},
+		Default:  func(net.Conn) { routed = "default" },
+	}
+	r.Route(conn)
+	if routed != "default" {
+		t.Fatalf("bad: %v", routed)
+	}
+	if h := conn.ProxyHeader(); h != nil {
+		t.Fatalf("bad: %v", h)
+	}
+	if _, ok := FromContext(conn.Context()); ok {
+		t.Fatalf("expected no header")
+	}
+}
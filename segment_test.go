@@ -0,0 +1,72 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// writeSlowly writes b to conn one byte at a time.
+func writeSlowly(conn net.Conn, b []byte, delay time.Duration) {
+	for i := range b {
+		if _, err := conn.Write(b[i : i+1]); err != nil {
+			return
+		}
+		time.Sleep(delay)
+	}
+}
+
+func TestParse_ByteAtATime(t *testing.T) {
+	v2 := v2Header(0x1, 0x11, []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0})
+	headers := [][]byte{
+		[]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"),
+		v2,
+	}
+
+	for _, header := range headers {
+		client, server := net.Pipe()
+		conn := NewConn(server, time.Second)
+
+		go writeSlowly(client, append(header, "ping"...), 0)
+
+		recv := make([]byte, 4)
+		if _, err := io.ReadFull(conn, recv); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(recv, []byte("ping")) {
+			t.Fatalf("bad: %v", recv)
+		}
+		if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+			t.Fatalf("bad: %v", addr)
+		}
+		client.Close()
+	}
+}
+
+func TestParse_TrickleTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// Each byte arrives well within the timeout, but the header as a
+	// whole does not.
+	timeout := 50 * time.Millisecond
+	conn := NewConn(server, timeout)
+	go func() {
+		client.Write([]byte("PROXY TCP4 "))
+		writeSlowly(client, []byte("10.1.1.1 20.2.2.2 1000 2000\r\n"), 10*time.Millisecond)
+	}()
+
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 4))
+	if _, ok := err.(*HeaderTimeoutError); !ok {
+		t.Fatalf("err: %v", err)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expected timeout: %v", err)
+	}
+	if d := time.Since(start); d > 4*timeout {
+		t.Fatalf("header read took %v", d)
+	}
+}
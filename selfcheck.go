@@ -0,0 +1,198 @@
+package proxyproto
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSelfCheckNoHeader is returned by SelfCheck when the connection
+	// made through the load balancer arrived without a header.
+	ErrSelfCheckNoHeader = errors.New("self-check connection arrived without PROXY header")
+)
+
+// SelfCheck verifies that the load balancer at lbAddress sends headers
+// to l, as a startup check for services moving to the proxy protocol.
+// It connects to lbAddress, sends a random token, and accepts
+// connections from l until one carries the token after its header. The
+// header is returned so that its addresses can be checked as well.
+//
+// Other connections accepted meanwhile, from real clients or from
+// probes sent to other instances by the load balancer, are not
+// consumed: once SelfCheck returns, they are returned by the next
+// Accept. They wait until then, so SelfCheck should run before l starts
+// serving, and ctx should carry a deadline, which also bounds accepting
+// if the underlying listener supports deadlines, as TCP listeners do.
+// Without deadline support, one more connection may be accepted after
+// SelfCheck returns, and is handed back in the same way.
+func SelfCheck(ctx context.Context, l *Listener, lbAddress string) (*Header, error) {
+	var d net.Dialer
+	client, err := d.DialContext(ctx, "tcp", lbAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	token := []byte("proxyproto-selfcheck " + hex.EncodeToString(nonce) + "\n")
+
+	deadline, hasDeadline := ctx.Deadline()
+	inner, _ := l.inner()
+	dl, canDeadline := inner.(interface{ SetDeadline(time.Time) error })
+	if hasDeadline {
+		client.SetDeadline(deadline)
+		if canDeadline {
+			dl.SetDeadline(deadline)
+		}
+	}
+	if _, err := client.Write(token); err != nil {
+		return nil, err
+	}
+
+	c := &selfChecker{
+		l:        l,
+		token:    token,
+		deadline: deadline,
+		found:    make(chan *Conn, 1),
+		stopped:  make(chan struct{}),
+		pending:  make(map[*Conn]bool),
+	}
+	acceptErr := make(chan error, 1)
+	go c.acceptLoop(acceptErr)
+	defer func() {
+		// Stop accepting and hand back the connections being checked
+		c.stop()
+		if canDeadline {
+			dl.SetDeadline(aLongTimeAgo)
+			<-c.stopped
+			dl.SetDeadline(time.Time{})
+		}
+		c.checks.Wait()
+	}()
+
+	var conn *Conn
+	select {
+	case conn = <-c.found:
+	case err := <-acceptErr:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer conn.Close()
+
+	buf := make([]byte, len(token))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	h := conn.ProxyHeader()
+	if h == nil {
+		return nil, ErrSelfCheckNoHeader
+	}
+	return h, nil
+}
+
+// selfChecker looks for the connection carrying the token of SelfCheck
+// among those accepted from l, handing the others back.
+type selfChecker struct {
+	l        *Listener
+	token    []byte
+	deadline time.Time
+	found    chan *Conn
+	stopped  chan struct{}
+
+	mu      sync.Mutex
+	done    bool
+	pending map[*Conn]bool
+	checks  sync.WaitGroup
+}
+
+// acceptLoop accepts connections and checks each of them concurrently,
+// so that clients that do not send anything do not hold up the check.
+func (c *selfChecker) acceptLoop(errc chan<- error) {
+	defer close(c.stopped)
+	c.l.init()
+	for {
+		conn, err := c.l.acceptProxy()
+		if err != nil {
+			errc <- err
+			return
+		}
+		c.mu.Lock()
+		if c.done {
+			c.mu.Unlock()
+			c.l.giveBack(conn)
+			return
+		}
+		c.checks.Add(1)
+		c.mu.Unlock()
+		go c.check(conn)
+	}
+}
+
+// check peeks at the data after the header of conn, without consuming
+// it, and reports conn if it starts with the token. It waits for data
+// before reading the header, so that stop never cuts a header short.
+func (c *selfChecker) check(conn *Conn) {
+	defer c.checks.Done()
+	if !c.wait(conn, func() { conn.waitForData() }) {
+		c.l.giveBack(conn)
+		return
+	}
+	conn.ProxyHeader()
+	var data []byte
+	if !c.wait(conn, func() { data, _ = conn.PeekApplicationData(len(c.token)) }) {
+		c.l.giveBack(conn)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done && bytes.Equal(data, c.token) {
+		c.done = true
+		c.found <- conn
+		return
+	}
+	c.l.giveBack(conn)
+}
+
+// wait runs fn, which reads from conn, so that stop can interrupt it.
+// It reports whether the check is still running.
+func (c *selfChecker) wait(conn *Conn, fn func()) bool {
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		return false
+	}
+	c.pending[conn] = true
+	conn.SetReadDeadline(c.deadline)
+	c.mu.Unlock()
+
+	fn()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, conn)
+	conn.SetReadDeadline(time.Time{})
+	return !c.done
+}
+
+// stop ends the check, interrupting the connections still being peeked
+// at, which then hand themselves back.
+func (c *selfChecker) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	for conn := range c.pending {
+		conn.SetReadDeadline(aLongTimeAgo)
+	}
+}
@@ -0,0 +1,175 @@
+package proxyproto
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeLB forwards connections to backend, prefixed with a header if
+// sendHeader is set, and returns its address.
+func fakeLB(t *testing.T, backend string, sendHeader bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", backend)
+			if err != nil {
+				client.Close()
+				return
+			}
+			if sendHeader {
+				HeaderFromConns(client, upstream).WriteTo(upstream)
+			}
+			go func() {
+				io.Copy(upstream, client)
+				upstream.Close()
+			}()
+			go func() {
+				io.Copy(client, upstream)
+				client.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestSelfCheck(t *testing.T) {
+	for _, sendHeader := range []bool{true, false} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		pl := &Listener{Listener: l}
+		defer pl.Close()
+		lb := fakeLB(t, pl.Addr().String(), sendHeader)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		h, err := SelfCheck(ctx, pl, lb)
+		cancel()
+		if !sendHeader {
+			if err != ErrSelfCheckNoHeader {
+				t.Fatalf("err: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if h.Version != 2 || h.DstAddr.String() != lb {
+			t.Fatalf("bad: %v", h)
+		}
+	}
+}
+
+func TestSelfCheck_Stalled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l, ProxyHeaderTimeout: time.Second}
+	defer pl.Close()
+
+	// The load balancer sends the header but never forwards the token
+	lbl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer lbl.Close()
+	go func() {
+		client, err := lbl.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		upstream, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		HeaderFromConns(client, upstream).WriteTo(upstream)
+		io.Copy(io.Discard, client)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := SelfCheck(ctx, pl, lbl.Addr().String())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("self-check ignored the context deadline")
+	}
+}
+
+func TestSelfCheck_HandsBackConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l}
+	defer pl.Close()
+	lb := fakeLB(t, pl.Addr().String(), true)
+
+	// A client sending data and a silent one arrive before the probe
+	talker, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer talker.Close()
+	if _, err := talker.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	silent, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := SelfCheck(ctx, pl, lb); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	found := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		// The silent client sends no header to read its address from
+		addr := conn.(*Conn).ProxyAddr().String()
+		found[addr] = true
+		if addr != talker.LocalAddr().String() {
+			continue
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(buf) != "ping" {
+			t.Fatalf("bad: %q", buf)
+		}
+	}
+	if !found[talker.LocalAddr().String()] || !found[silent.LocalAddr().String()] {
+		t.Fatalf("bad: %v", found)
+	}
+}
@@ -0,0 +1,78 @@
+package proxyproto
+
+import (
+	"context"
+	"log"
+	"net"
+	"runtime/debug"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown checks for connections
+// still being served.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Serve accepts connections and calls handler for each of them in its
+// own goroutine, once its header has been read. Connections failing to
+// send a valid header are closed without calling handler. The
+// connection is closed when handler returns, and panics in handler are
+// recovered and logged. Temporary accept errors are retried with a
+// backoff. Serve returns net.ErrClosed after Shutdown, or the first
+// permanent accept error otherwise.
+func (p *Listener) Serve(handler func(*Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := p.AcceptProxy()
+		if err != nil {
+			if p.shutdown.Load() {
+				return net.ErrClosed
+			}
+			if !isTemporary(err) {
+				return err
+			}
+			delay = acceptBackoff(delay)
+			log.Printf("[ERR] Accept error: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		p.serving.Add(1)
+		go p.serveConn(conn, handler)
+	}
+}
+
+// serveConn reads the header of conn and calls handler.
+func (p *Listener) serveConn(conn *Conn, handler func(*Conn)) {
+	defer p.serving.Add(-1)
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[ERR] Panic serving conn %d: %v\n%s", conn.ID(), r, debug.Stack())
+		}
+	}()
+
+	if err := conn.checkPrefixOnce(); err != nil {
+		return
+	}
+	handler(conn)
+}
+
+// Shutdown closes the listener, making Serve return, and waits for the
+// handlers of the connections being served to return. If ctx is done
+// first, its error is returned and the handlers are left running.
+func (p *Listener) Shutdown(ctx context.Context) error {
+	p.shutdown.Store(true)
+	err := p.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for p.serving.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
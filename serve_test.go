@@ -0,0 +1,75 @@
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l, ProxyHeaderTimeout: time.Second}
+
+	release := make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- pl.Serve(func(conn *Conn) {
+			recv := make([]byte, 4)
+			if _, err := io.ReadFull(conn, recv); err != nil {
+				return
+			}
+			if string(recv) == "boom" {
+				panic("boom")
+			}
+			conn.Write([]byte(conn.RemoteAddr().String() + "\n"))
+			<-release
+		})
+	}()
+
+	header := "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"
+	client, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte(header + "ping"))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if line != "10.1.1.1:1000\n" {
+		t.Fatalf("bad: %q", line)
+	}
+
+	// A panicking handler only loses its own connection
+	panicky, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer panicky.Close()
+	panicky.Write([]byte(header + "boom"))
+	if _, err := panicky.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Shutdown waits for the remaining handler
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := pl.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("err: %v", err)
+	}
+	close(release)
+	if err := pl.Shutdown(context.Background()); err != nil && !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("err: %v", err)
+	}
+}
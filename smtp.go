@@ -0,0 +1,26 @@
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// smtpServiceNotAvailable is the reply sent to SMTP clients whose
+// connection did not carry a required header.
+const smtpServiceNotAvailable = "421 4.3.2 Service not available\r\n"
+
+// WriteGreeting writes the greeting of a write-first server, such as
+// "220 mx.example.com ESMTP\r\n", to conn. If conn is a *Conn created
+// with RequireHeaderBeforeWrite and no header was received, a 421 reply
+// is written instead, conn is closed and ErrHeaderRequired is returned.
+func WriteGreeting(conn net.Conn, greeting string) error {
+	_, err := io.WriteString(conn, greeting)
+	if errors.Is(err, ErrHeaderRequired) {
+		if pc, ok := conn.(*Conn); ok {
+			io.WriteString(pc.NetConn(), smtpServiceNotAvailable)
+		}
+		conn.Close()
+	}
+	return err
+}
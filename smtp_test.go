@@ -0,0 +1,151 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteGreeting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{
+		Listener:                 l,
+		ProxyHeaderTimeout:       time.Second,
+		RequireHeaderBeforeWrite: true,
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+		io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	if err := WriteGreeting(conn, "220 mx.example.com ESMTP\r\n"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestWriteGreeting_HeaderRequired(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{
+		Listener:                 l,
+		ProxyHeaderTimeout:       50 * time.Millisecond,
+		RequireHeaderBeforeWrite: true,
+	}
+
+	reply := make(chan string, 1)
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// Wait for the greeting without sending a header
+		recv, _ := io.ReadAll(conn)
+		reply <- string(recv)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	err = WriteGreeting(conn, "220 mx.example.com ESMTP\r\n")
+	if err != ErrHeaderRequired {
+		t.Fatalf("err: %v", err)
+	}
+	if r := <-reply; r != smtpServiceNotAvailable {
+		t.Fatalf("bad: %q", r)
+	}
+}
+
+func TestWriteGreeting_RemoteAddrFirst(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{
+		Listener:                 l,
+		ProxyHeaderTimeout:       50 * time.Millisecond,
+		RequireHeaderBeforeWrite: true,
+	}
+
+	reply := make(chan string, 1)
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		recv, _ := io.ReadAll(conn)
+		reply <- string(recv)
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Logging the client address first reads the header, which must
+	// not close the connection before the reply
+	if addr := conn.RemoteAddr(); addr == nil {
+		t.Fatalf("bad: %v", addr)
+	}
+	err = WriteGreeting(conn, "220 mx.example.com ESMTP\r\n")
+	if err != ErrHeaderRequired {
+		t.Fatalf("err: %v", err)
+	}
+	if r := <-reply; r != smtpServiceNotAvailable {
+		t.Fatalf("bad: %q", r)
+	}
+}
+
+func TestRequireHeaderBeforeWrite_Untrusted(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	untrusted := func(net.Addr) (bool, error) { return false, nil }
+	conn := Wrap(server,
+		WithProxyHeaderTimeout(50*time.Millisecond),
+		WithSourceCheck(untrusted),
+		WithRequireHeaderBeforeWrite())
+	defer conn.Close()
+
+	go io.Copy(io.Discard, client)
+
+	// Untrusted sources are not expected to send a header
+	if _, err := conn.Write([]byte("220 ready\r\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+package proxyproto
+
+// reapIfStale closes the connection if nothing has been received over
+// it, as checked when StaleConnTimeout expires.
+func (p *Conn) reapIfStale() {
+	if p.received.Load() {
+		return
+	}
+	if pending, ok := socketHasData(p.conn); !ok || pending {
+		return
+	}
+	p.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package proxyproto
+
+import "net"
+
+// socketHasData cannot check sockets for pending data on this platform.
+func socketHasData(conn net.Conn) (pending bool, ok bool) {
+	return false, false
+}
@@ -0,0 +1,39 @@
+//go:build unix
+
+package proxyproto
+
+import (
+	"net"
+	"syscall"
+)
+
+// socketHasData reports whether data is waiting to be read from the
+// socket of conn, without consuming it. The second result is false if
+// this cannot be determined.
+func socketHasData(conn net.Conn) (pending bool, ok bool) {
+	sc, isSyscall := conn.(syscall.Conn)
+	if !isSyscall {
+		return false, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+
+	// Control does not wait for a Read in progress, unlike Read
+	var buf [1]byte
+	err = raw.Control(func(fd uintptr) {
+		n, _, rerr := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		switch {
+		case rerr == syscall.EAGAIN || rerr == syscall.EWOULDBLOCK:
+			ok = true
+		case rerr == nil:
+			// A zero length read means the peer closed the connection
+			pending, ok = n > 0, true
+		}
+	})
+	if err != nil {
+		return false, false
+	}
+	return pending, ok
+}
@@ -0,0 +1,105 @@
+//go:build unix
+
+package proxyproto
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStaleConnTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l, StaleConnTimeout: 50 * time.Millisecond}
+	defer pl.Close()
+
+	inputs := []string{"", "ping", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"}
+	for _, input := range inputs {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(input))
+	}
+
+	// A silent client is closed while the application waits for data
+	conn, err := pl.AcceptProxy()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Data the application has not read yet keeps the connection open
+	conn, err = pl.AcceptProxy()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil || string(recv) != "ping" {
+		t.Fatalf("bad: %q %v", recv, err)
+	}
+
+	// A header counts as data even if nothing follows it
+	conn, err = pl.AcceptProxy()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestStaleConnTimeout_HeaderOnAccept(t *testing.T) {
+	for _, fromAccept := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		pl := &Listener{
+			Listener:                l,
+			StaleConnTimeout:        50 * time.Millisecond,
+			ReadHeaderOnAccept:      !fromAccept,
+			HeaderTimeoutFromAccept: fromAccept,
+		}
+
+		client, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+
+		// The header and data were read into the buffer on accept, which
+		// must not make the connection look silent
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, err := conn.Write([]byte("pong")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		recv := make([]byte, 4)
+		if _, err := conn.Read(recv); err != nil || string(recv) != "ping" {
+			t.Fatalf("bad: %q %v", recv, err)
+		}
+		conn.Close()
+		client.Close()
+		pl.Close()
+	}
+}
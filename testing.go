@@ -0,0 +1,98 @@
+package proxyproto
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewTestConn returns a Conn wrapping inner that behaves as if hdr had
+// already been read from it, so applications can simulate proxied
+// clients in tests without writing a header on the wire. A nil hdr
+// simulates a connection without a header.
+func NewTestConn(inner net.Conn, hdr *Header) *Conn {
+	return AttachHeader(inner, hdr)
+}
+
+// FakeClock is a Clock whose time only moves when Advance is called, so
+// that tests of timeouts run instantly and deterministically.
+type FakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	pending []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	f     func()
+}
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc calls f once the clock is advanced by d or more.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	c.pending = append(c.pending, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by d, calling the functions of the
+// timers that expire, in order, before returning.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.pending, func(i, j int) bool { return c.pending[i].when.Before(c.pending[j].when) })
+	var expired []*fakeTimer
+	for len(c.pending) > 0 && !c.pending[0].when.After(c.now) {
+		expired = append(expired, c.pending[0])
+		c.pending = c.pending[1:]
+	}
+	c.mu.Unlock()
+
+	for _, t := range expired {
+		t.f()
+	}
+}
+
+// BlockUntil waits until n timers are pending, such as the header
+// timeout of a connection once its header is being read, so that
+// Advance is not called too early.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.pending) < n {
+		c.cond.Wait()
+	}
+}
+
+// Stop removes the timer, reporting whether it was pending.
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.pending {
+		if p == t {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
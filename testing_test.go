@@ -0,0 +1,46 @@
+package proxyproto
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestNewTestConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	src := netip.MustParseAddrPort("10.1.1.1:1000")
+	dst := netip.MustParseAddrPort("20.2.2.2:2000")
+	conn := NewTestConn(server, NewHeaderV2(src, dst))
+	defer conn.Close()
+
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+	if addr := conn.LocalAddr().String(); addr != "20.2.2.2:2000" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	// Reads go straight to the inner connection
+	go client.Write([]byte("PROXY TCP4 6.6.6.6 20.2.2.2 1000 2000\r\n"))
+	recv := make([]byte, 5)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "PROXY" {
+		t.Fatalf("bad: %v", recv)
+	}
+}
+
+func TestNewHeader(t *testing.T) {
+	h := NewHeaderV1(netip.MustParseAddrPort("[::ffff:10.1.1.1]:1000"), netip.MustParseAddrPort("20.2.2.2:2000"))
+	if h.Version != 1 || h.Protocol != "TCP4" || h.SrcAddr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %+v", h)
+	}
+
+	h = NewHeaderV2(netip.MustParseAddrPort("[::1]:1000"), netip.MustParseAddrPort("[::2]:2000"))
+	if h.Version != 2 || h.Protocol != "TCP6" || h.DstAddr.String() != "[::2]:2000" {
+		t.Fatalf("bad: %+v", h)
+	}
+}
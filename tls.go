@@ -0,0 +1,61 @@
+package proxyproto
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// tlsListener reads the proxy header of accepted connections before
+// performing the TLS handshake on them.
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+	opts   []Option
+}
+
+// NewTLSListener returns a listener for connections that send the proxy
+// header in plain text before starting TLS, as load balancers in TCP
+// mode do. Accepted connections are wrapped with Wrap using opts and
+// then with tls.Server, so the returned *tls.Conn has the client's
+// RemoteAddr and its ConnectionState is available as usual.
+func NewTLSListener(inner net.Listener, config *tls.Config, opts ...Option) net.Listener {
+	return &tlsListener{Listener: inner, config: config, opts: opts}
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(Wrap(conn, l.opts...), l.config), nil
+}
+
+// innerTLSListener performs the TLS handshake on accepted connections
+// before reading the proxy header from the decrypted stream.
+type innerTLSListener struct {
+	net.Listener
+	config *tls.Config
+	opts   []Option
+}
+
+// NewInnerTLSListener returns a listener for connections that send the
+// proxy header inside TLS, as done by internal hops that encrypt the
+// whole stream, for example with WriteHeader once their handshake is
+// done. Accepted connections are wrapped with tls.Server and then with
+// Wrap using opts, so they are *Conn whose NetConn is the *tls.Conn.
+// The handshake happens on first use, within ProxyHeaderTimeout if set.
+// As the returned connections are not *tls.Conn, servers such as
+// net/http do not see them as TLS connections.
+func NewInnerTLSListener(inner net.Listener, config *tls.Config, opts ...Option) net.Listener {
+	return &innerTLSListener{Listener: inner, config: config, opts: opts}
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *innerTLSListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(tls.Server(conn, l.config), l.opts...), nil
+}
@@ -0,0 +1,190 @@
+package proxyproto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTLSConfig returns a server config with a self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tl := NewTLSListener(l, testTLSConfig(t), WithProxyHeaderTimeout(time.Second))
+	defer tl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", tl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		tlsConn.Write([]byte("ping"))
+		tlsConn.Read(make([]byte, 4))
+	}()
+
+	conn, err := tl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "ping" {
+		t.Fatalf("bad: %v", recv)
+	}
+	conn.Write([]byte("pong"))
+
+	tlsConn := conn.(*tls.Conn)
+	if !tlsConn.ConnectionState().HandshakeComplete {
+		t.Fatalf("handshake not complete")
+	}
+	if addr := tlsConn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestInnerTLSListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tl := NewInnerTLSListener(l, testTLSConfig(t), WithProxyHeaderTimeout(time.Second))
+	defer tl.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", tl.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+		conn.Write([]byte("ping"))
+		conn.Read(make([]byte, 4))
+	}()
+
+	conn, err := tl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "ping" {
+		t.Fatalf("bad: %v", recv)
+	}
+	conn.Write([]byte("pong"))
+
+	if addr := conn.RemoteAddr().String(); addr != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", addr)
+	}
+	tlsConn := conn.(*Conn).NetConn().(*tls.Conn)
+	if !tlsConn.ConnectionState().HandshakeComplete {
+		t.Fatalf("handshake not complete")
+	}
+}
+
+func TestInnerTLSListener_HeaderOutside(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tl := NewInnerTLSListener(l, testTLSConfig(t), WithProxyHeaderTimeout(time.Second))
+	defer tl.Close()
+
+	// A header in plain text fails the handshake
+	go func() {
+		conn, err := net.Dial("tcp", tl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+		conn.Read(make([]byte, 1))
+	}()
+
+	conn, err := tl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestListener_DirectTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A direct TLS client must not wait for the header timeout
+	timeout := 2 * time.Second
+	tl := NewTLSListener(l, testTLSConfig(t), WithProxyHeaderTimeout(timeout))
+	defer tl.Close()
+
+	go func() {
+		conn, err := tl.Accept()
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("pong"))
+	}()
+
+	start := time.Now()
+	conn, err := tls.Dial("tcp", tl.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if d := time.Since(start); d >= timeout {
+		t.Fatalf("handshake took %v", d)
+	}
+}
@@ -0,0 +1,67 @@
+package proxyproto
+
+import "time"
+
+// HeaderTrace is a set of hooks called while a header is read, to debug
+// interoperability with load balancers. Any of the hooks may be nil.
+type HeaderTrace struct {
+	// SignatureDetected is called with the version of the signature
+	// found at the start of the stream, or zero if there is none.
+	SignatureDetected func(version int)
+
+	// BytesRead is called with the raw bytes of each header read,
+	// whether or not it turns out to be valid.
+	BytesRead func(b []byte)
+
+	// TLVFound is called for each TLV of a version 2 header.
+	TLVFound func(tlv TLV)
+
+	// HeaderParsed is called with each header successfully parsed.
+	HeaderParsed func(h *Header)
+
+	// Error is called with the error that failed reading the header.
+	Error func(err error)
+
+	// Done is called once reading the header of conn is over, with the
+	// time it started, the header, which is nil if there was none, and
+	// the error, so that the whole read can be timed.
+	Done func(conn *Conn, start time.Time, h *Header, err error)
+}
+
+func (t *HeaderTrace) signatureDetected(version int) {
+	if t != nil && t.SignatureDetected != nil {
+		t.SignatureDetected(version)
+	}
+}
+
+func (t *HeaderTrace) bytesRead(b []byte) {
+	if t != nil && t.BytesRead != nil {
+		t.BytesRead(b)
+	}
+}
+
+func (t *HeaderTrace) headerParsed(h *Header) {
+	if t == nil {
+		return
+	}
+	if t.TLVFound != nil {
+		for _, tlv := range h.TLVs {
+			t.TLVFound(tlv)
+		}
+	}
+	if t.HeaderParsed != nil {
+		t.HeaderParsed(h)
+	}
+}
+
+func (t *HeaderTrace) error(err error) {
+	if t != nil && t.Error != nil {
+		t.Error(err)
+	}
+}
+
+func (t *HeaderTrace) done(conn *Conn, start time.Time, h *Header, err error) {
+	if t != nil && t.Done != nil {
+		t.Done(conn, start, h, err)
+	}
+}
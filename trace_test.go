@@ -0,0 +1,83 @@
+package proxyproto
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHeaderTrace(t *testing.T) {
+	var events []string
+	trace := &HeaderTrace{
+		SignatureDetected: func(version int) { events = append(events, fmt.Sprintf("sig %d", version)) },
+		BytesRead:         func(b []byte) { events = append(events, fmt.Sprintf("read %d", len(b))) },
+		TLVFound:          func(tlv TLV) { events = append(events, fmt.Sprintf("tlv %#x", tlv.Type)) },
+		HeaderParsed:      func(h *Header) { events = append(events, "parsed "+h.Protocol) },
+		Error:             func(err error) { events = append(events, "error") },
+	}
+
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0, 0x01, 0, 2, 'h', '2'}
+	input := append(v2Header(0x1, 0x11, payload), "ping"...)
+	conn := Wrap(&bufConn{r: bytes.NewReader(input)}, WithTrace(trace))
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []string{"sig 2", "read 33", "tlv 0x1", "parsed TCP4"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("bad: %v", events)
+	}
+
+	events = nil
+	input = []byte("PROXY TCP4 what 20.2.2.2 1000 2000\r\nping")
+	conn = Wrap(&bufConn{r: bytes.NewReader(input)}, WithTrace(trace))
+	if _, err := conn.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("expected error")
+	}
+	expected = []string{"sig 1", "read 36", "error"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("bad: %v", events)
+	}
+
+	events = nil
+	conn = Wrap(&bufConn{r: bytes.NewReader([]byte("ping"))}, WithTrace(trace))
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(events, []string{"sig 0"}) {
+		t.Fatalf("bad: %v", events)
+	}
+}
+
+func TestHeaderTrace_Done(t *testing.T) {
+	var calls int
+	var header *Header
+	var traceErr error
+	trace := &HeaderTrace{
+		Done: func(conn *Conn, start time.Time, h *Header, err error) {
+			calls++
+			header, traceErr = h, err
+			if start.IsZero() || start.After(time.Now()) {
+				t.Errorf("bad: %v", start)
+			}
+		},
+	}
+
+	input := []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping")
+	conn := Wrap(&bufConn{r: bytes.NewReader(input)}, WithTrace(trace))
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Read(make([]byte, 4))
+	if calls != 1 || header == nil || traceErr != nil {
+		t.Fatalf("bad: %d %v %v", calls, header, traceErr)
+	}
+
+	input = []byte("PROXY TCP4 what 20.2.2.2 1000 2000\r\nping")
+	conn = Wrap(&bufConn{r: bytes.NewReader(input)}, WithTrace(trace))
+	conn.Read(make([]byte, 4))
+	if calls != 2 || header != nil || traceErr == nil {
+		t.Fatalf("bad: %d %v %v", calls, header, traceErr)
+	}
+}
@@ -0,0 +1,145 @@
+package proxyproto
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a version of the protocol, as in Header.Version.
+type Version int
+
+// Versions of the protocol.
+const (
+	V1 Version = 1
+	V2 Version = 2
+)
+
+func (v Version) String() string {
+	return "v" + strconv.Itoa(int(v))
+}
+
+// Command is the command of a version 2 header, with its wire value.
+type Command byte
+
+// Commands of version 2 headers. Version 1 headers are always PROXY.
+const (
+	CommandLocal Command = 0x0
+	CommandProxy Command = 0x1
+)
+
+func (c Command) String() string {
+	switch c {
+	case CommandLocal:
+		return "LOCAL"
+	case CommandProxy:
+		return "PROXY"
+	}
+	return fmt.Sprintf("Command(%#x)", byte(c))
+}
+
+// AddressFamily is the address family of a version 2 header, with its
+// wire value.
+type AddressFamily byte
+
+// Address families of version 2 headers.
+const (
+	AFUnspec AddressFamily = 0x0
+	AFInet   AddressFamily = 0x1
+	AFInet6  AddressFamily = 0x2
+	AFUnix   AddressFamily = 0x3
+)
+
+func (f AddressFamily) String() string {
+	switch f {
+	case AFUnspec:
+		return "UNSPEC"
+	case AFInet:
+		return "INET"
+	case AFInet6:
+		return "INET6"
+	case AFUnix:
+		return "UNIX"
+	}
+	return fmt.Sprintf("AddressFamily(%#x)", byte(f))
+}
+
+// PolicyDecision is how the header of a connection is treated according
+// to SourceCheck, as returned by Conn.PolicyDecision.
+type PolicyDecision int
+
+// Policy decisions.
+const (
+	// PolicyNone is the decision for connections without SourceCheck.
+	PolicyNone PolicyDecision = iota
+
+	// PolicyUse means the source is trusted and its header, if any,
+	// provides the addresses of the connection.
+	PolicyUse
+
+	// PolicyRequire means the source is trusted and must send a header,
+	// as set by RequireHeaderBeforeWrite.
+	PolicyRequire
+
+	// PolicyIgnore means the source is not trusted, so the connection
+	// keeps the addresses of the socket.
+	PolicyIgnore
+)
+
+func (d PolicyDecision) String() string {
+	switch d {
+	case PolicyNone:
+		return "NONE"
+	case PolicyUse:
+		return "USE"
+	case PolicyRequire:
+		return "REQUIRE"
+	case PolicyIgnore:
+		return "IGNORE"
+	}
+	return fmt.Sprintf("PolicyDecision(%d)", int(d))
+}
+
+// Transport is the proxied protocol of a header, as found in its
+// Protocol field.
+type Transport string
+
+// Transports of the headers.
+const (
+	TCP4       Transport = "TCP4"
+	TCP6       Transport = "TCP6"
+	UDP4       Transport = "UDP4"
+	UDP6       Transport = "UDP6"
+	UnixStream Transport = "UNIX_STREAM"
+	UnixDgram  Transport = "UNIX_DGRAM"
+	Unspec     Transport = "UNSPEC"
+	Unknown    Transport = "UNKNOWN"
+)
+
+func (t Transport) String() string {
+	return string(t)
+}
+
+// Family returns the address family of the transport.
+func (t Transport) Family() AddressFamily {
+	switch t {
+	case TCP4, UDP4:
+		return AFInet
+	case TCP6, UDP6:
+		return AFInet6
+	case UnixStream, UnixDgram:
+		return AFUnix
+	}
+	return AFUnspec
+}
+
+// ParseTransport parses the name of a transport, such as "TCP4" or
+// "unix_stream", ignoring case.
+func ParseTransport(s string) (Transport, error) {
+	t := Transport(strings.ToUpper(s))
+	switch t {
+	case TCP4, TCP6, UDP4, UDP6, UnixStream, UnixDgram, Unspec, Unknown:
+		return t, nil
+	}
+	return "", fmt.Errorf("Unknown transport: %q", s)
+}
@@ -0,0 +1,50 @@
+package proxyproto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnumStrings(t *testing.T) {
+	cases := map[string]string{
+		V1.String():                 "v1",
+		V2.String():                 "v2",
+		CommandLocal.String():       "LOCAL",
+		CommandProxy.String():       "PROXY",
+		Command(0x7).String():       "Command(0x7)",
+		AFInet6.String():            "INET6",
+		AddressFamily(9).String():   "AddressFamily(0x9)",
+		UnixStream.String():         "UNIX_STREAM",
+		UDP4.Family().String():      "INET",
+		Unknown.Family().String():   "UNSPEC",
+		UnixDgram.Family().String(): "UNIX",
+	}
+	for got, expected := range cases {
+		if got != expected {
+			t.Fatalf("bad: %s != %s", got, expected)
+		}
+	}
+}
+
+func TestParseTransport(t *testing.T) {
+	for _, s := range []string{"TCP4", "tcp6", "Udp4", "UDP6", "unix_stream", "UNIX_DGRAM", "UNSPEC", "unknown"} {
+		tr, err := ParseTransport(s)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if tr.String() != strings.ToUpper(s) {
+			t.Fatalf("bad: %v", tr)
+		}
+	}
+	if _, err := ParseTransport("SCTP"); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Header protocols convert directly
+	h := parseBytes(t, []byte("PROXY TCP6 ::1 ::2 1000 2000\r\n"))
+	switch Transport(h.Protocol) {
+	case TCP6:
+	default:
+		t.Fatalf("bad: %v", h.Protocol)
+	}
+}
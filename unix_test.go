@@ -0,0 +1,74 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestParse_UnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+	defer pl.Close()
+
+	udp := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	headers := [][]byte{
+		[]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"),
+		v2Header(0x1, 0x12, udp),
+	}
+	expected := []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+		&net.UDPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+	}
+
+	for i, header := range headers {
+		client, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer client.Close()
+		client.Write(append(header, "ping"...))
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+
+		recv := make([]byte, 4)
+		if _, err := conn.Read(recv); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(recv, []byte("ping")) {
+			t.Fatalf("bad: %v", recv)
+		}
+
+		addr := conn.RemoteAddr()
+		if addr.Network() != expected[i].Network() || addr.String() != expected[i].String() {
+			t.Fatalf("bad: %v", addr)
+		}
+	}
+
+	// Without a header the unix peer is returned
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("ping"))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.RemoteAddr().(*net.UnixAddr); !ok {
+		t.Fatalf("bad: %v", conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,220 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	// v2HeaderLen is the length of the fixed part of a version 2 header:
+	// the signature, version and command, family and payload length.
+	v2HeaderLen = 16
+
+	// Address lengths of the supported families
+	v2AddrLenInet  = 12
+	v2AddrLenInet6 = 36
+	v2AddrLenUnix  = 216
+)
+
+// Types of the TLVs defined by the specification.
+const (
+	TLVTypeALPN      = 0x01
+	TLVTypeAuthority = 0x02
+	TLVTypeCRC32C    = 0x03
+	TLVTypeNoop      = 0x04
+	TLVTypeUniqueID  = 0x05
+	TLVTypeSSL       = 0x20
+	TLVTypeNetNS     = 0x30
+)
+
+// TLV is a Type-Length-Value extension of a version 2 header.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// readV2 reads and parses a binary version 2 header. Headers that fit
+// in the read buffer are only consumed once they are valid.
+func (p *Conn) readV2() (*Header, error) {
+	fixed, err := p.bufReader.Peek(v2HeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+
+	// Refuse oversized TLVs before allocating for them
+	if p.maxTLVBytes > 0 && length > v2AddrLen(fixed[13])+p.maxTLVBytes {
+		return nil, ErrTLVTooLarge
+	}
+	if v2HeaderLen+length > p.remainingHeaderBytes() {
+		return nil, ErrHeaderTooLarge
+	}
+
+	// Headers are replayed as data on fallback, so they must fit
+	if p.fallbackOnError && v2HeaderLen+length > p.bufReader.Size() {
+		p.growBuffer(v2HeaderLen + length)
+	}
+
+	var buf []byte
+	peek := v2HeaderLen+length <= p.bufReader.Size()
+	if peek {
+		peeked, err := p.bufReader.Peek(v2HeaderLen + length)
+		if err != nil {
+			return nil, err
+		}
+		buf = append([]byte(nil), peeked...)
+	} else {
+		buf = make([]byte, v2HeaderLen+length)
+		if _, err := io.ReadFull(p.bufReader, buf); err != nil {
+			return nil, err
+		}
+	}
+
+	p.addHeaderLen(len(buf))
+	p.trace.bytesRead(buf)
+
+	h, err := parseV2(buf[:v2HeaderLen], buf[v2HeaderLen:])
+	if err != nil {
+		return nil, err
+	}
+	if p.maxTLVCount > 0 && len(h.TLVs) > p.maxTLVCount {
+		return nil, ErrTLVTooLarge
+	}
+	if peek {
+		p.bufReader.Discard(len(buf))
+	}
+	return h, nil
+}
+
+// growBuffer replaces the read buffer with one of the given size,
+// holding the same buffered data.
+func (p *Conn) growBuffer(size int) {
+	buffered, _ := p.bufReader.Peek(p.bufReader.Buffered())
+	r := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(buffered), p.source()), size)
+
+	// Move the data into the new buffer, so that reads bypassing the
+	// buffer once it is drained do not skip any of it
+	r.Peek(len(buffered))
+	p.bufReader = r
+}
+
+// v2AddrLen returns the length of the address block for the given
+// family and transport byte.
+func v2AddrLen(fam byte) int {
+	switch fam >> 4 {
+	case 0x1:
+		return v2AddrLenInet
+	case 0x2:
+		return v2AddrLenInet6
+	case 0x3:
+		return v2AddrLenUnix
+	}
+	return 0
+}
+
+// parseV2 parses the fixed part and payload of a version 2 header.
+func parseV2(fixed, payload []byte) (*Header, error) {
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("Invalid v2 version: %d", fixed[12]>>4)
+	}
+
+	h := &Header{Version: 2}
+	switch fixed[12] & 0x0F {
+	case 0x0:
+		h.Command = "LOCAL"
+	case 0x1:
+		h.Command = "PROXY"
+	default:
+		return nil, fmt.Errorf("Invalid v2 command: %#x", fixed[12]&0x0F)
+	}
+
+	var addrLen int
+	switch fixed[13] {
+	case 0x00:
+		h.Protocol = "UNSPEC"
+	case 0x11:
+		h.Protocol, addrLen = "TCP4", v2AddrLenInet
+	case 0x12:
+		h.Protocol, addrLen = "UDP4", v2AddrLenInet
+	case 0x21:
+		h.Protocol, addrLen = "TCP6", v2AddrLenInet6
+	case 0x22:
+		h.Protocol, addrLen = "UDP6", v2AddrLenInet6
+	case 0x31:
+		h.Protocol, addrLen = "UNIX_STREAM", v2AddrLenUnix
+	case 0x32:
+		h.Protocol, addrLen = "UNIX_DGRAM", v2AddrLenUnix
+	default:
+		return nil, fmt.Errorf("Unhandled v2 address family: %#x", fixed[13])
+	}
+	if len(payload) < addrLen {
+		return nil, fmt.Errorf("Invalid v2 address length: %d", len(payload))
+	}
+
+	// Addresses of LOCAL connections must be ignored
+	if h.Command == "PROXY" {
+		h.SrcAddr, h.DstAddr = parseV2Addrs(h.Protocol, payload[:addrLen])
+	}
+
+	tlvs, err := parseTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+	return h, nil
+}
+
+// parseV2Addrs decodes the address block of a version 2 header.
+func parseV2Addrs(protocol string, b []byte) (src, dst net.Addr) {
+	switch protocol {
+	case "TCP4", "UDP4", "TCP6", "UDP6":
+		ipLen := (len(b) - 4) / 2
+		srcIP := net.IP(append([]byte(nil), b[:ipLen]...))
+		dstIP := net.IP(append([]byte(nil), b[ipLen:2*ipLen]...))
+		srcPort := int(binary.BigEndian.Uint16(b[2*ipLen:]))
+		dstPort := int(binary.BigEndian.Uint16(b[2*ipLen+2:]))
+		if protocol[:3] == "UDP" {
+			return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}
+		}
+		return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}
+	case "UNIX_STREAM", "UNIX_DGRAM":
+		network := "unix"
+		if protocol == "UNIX_DGRAM" {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: unixPath(b[:108]), Net: network},
+			&net.UnixAddr{Name: unixPath(b[108:]), Net: network}
+	}
+	return nil, nil
+}
+
+// unixPath returns the NUL terminated path in b.
+func unixPath(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// parseTLVs splits the remainder of a version 2 payload into TLVs.
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("Truncated TLV")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, fmt.Errorf("Invalid TLV length: %d", n)
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return tlvs, nil
+}
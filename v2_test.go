@@ -0,0 +1,331 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// v2Header builds a version 2 header with the given command, family and
+// payload.
+func v2Header(cmd, fam byte, payload []byte) []byte {
+	buf := append([]byte(nil), sigV2...)
+	buf = append(buf, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(buf[14:], uint16(len(payload)))
+	return append(buf, payload...)
+}
+
+func TestParse_v2_ipv4(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// Write out the header, with a TLV!
+		payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+		payload = append(payload, 0x01, 0x00, 0x02, 'h', '2')
+		conn.Write(v2Header(0x1, 0x11, payload))
+
+		conn.Write([]byte("ping"))
+		recv := make([]byte, 4)
+		_, err = conn.Read(recv)
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		if !bytes.Equal(recv, []byte("pong")) {
+			t.Errorf("bad: %v", recv)
+			return
+		}
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	recv := make([]byte, 4)
+	_, err = conn.Read(recv)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(recv, []byte("ping")) {
+		t.Fatalf("bad: %v", recv)
+	}
+
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Check the remote and local addr
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+	if addr.IP.String() != "10.1.1.1" || addr.Port != 1000 {
+		t.Fatalf("bad: %v", addr)
+	}
+	addr = conn.LocalAddr().(*net.TCPAddr)
+	if addr.IP.String() != "20.2.2.2" || addr.Port != 2000 {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	h := conn.(*Conn).proxyHeader()
+	if len(h.TLVs) != 1 || h.TLVs[0].Type != 0x01 || string(h.TLVs[0].Value) != "h2" {
+		t.Fatalf("bad: %v", h.TLVs)
+	}
+}
+
+func TestParseV2(t *testing.T) {
+	ipv6 := make([]byte, v2AddrLenInet6)
+	ipv6[15] = 1
+	ipv6[31] = 2
+	binary.BigEndian.PutUint16(ipv6[32:], 1000)
+	binary.BigEndian.PutUint16(ipv6[34:], 2000)
+
+	unix := make([]byte, v2AddrLenUnix)
+	copy(unix, "/src.sock")
+	copy(unix[108:], "/dst.sock")
+
+	cases := []struct {
+		name    string
+		cmd     byte
+		fam     byte
+		payload []byte
+		src     string
+		err     bool
+	}{
+		{"tcp6", 0x1, 0x21, ipv6, "[::1]:1000", false},
+		{"udp6", 0x1, 0x22, ipv6, "[::1]:1000", false},
+		{"unix", 0x1, 0x31, unix, "/src.sock", false},
+		{"local", 0x0, 0x21, ipv6, "", false},
+		{"unspec", 0x1, 0x00, nil, "", false},
+		{"short address", 0x1, 0x21, ipv6[:10], "", true},
+		{"bad command", 0x2, 0x11, ipv6, "", true},
+		{"bad family", 0x1, 0x41, ipv6, "", true},
+		{"truncated tlv", 0x1, 0x21, append(ipv6, 0x01, 0x00), "", true},
+		{"bad tlv length", 0x1, 0x21, append(ipv6, 0x01, 0x00, 0x05, 'x'), "", true},
+	}
+
+	for _, c := range cases {
+		buf := v2Header(c.cmd, c.fam, c.payload)
+		h, err := parseV2(buf[:v2HeaderLen], buf[v2HeaderLen:])
+		if c.err {
+			if err == nil {
+				t.Fatalf("%s: expected error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: err: %v", c.name, err)
+		}
+		if c.src == "" {
+			if h.SrcAddr != nil {
+				t.Fatalf("%s: bad: %v", c.name, h.SrcAddr)
+			}
+			continue
+		}
+		if h.SrcAddr.String() != c.src {
+			t.Fatalf("%s: bad: %v", c.name, h.SrcAddr)
+		}
+	}
+}
+
+func TestAcceptProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{Listener: l}
+	defer pl.Close()
+
+	client, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	payload = append(payload, 0x02, 0x00, 0x03, 'f', 'o', 'o')
+	client.Write(v2Header(0x1, 0x11, payload))
+
+	conn, err := pl.AcceptProxy()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	if h := conn.ProxyHeader(); h == nil || h.Version != 2 {
+		t.Fatalf("bad: %v", h)
+	}
+	tlvs := conn.TLVs()
+	if len(tlvs) != 1 || tlvs[0].Type != 0x02 || string(tlvs[0].Value) != "foo" {
+		t.Fatalf("bad: %v", tlvs)
+	}
+}
+
+func TestParse_v2_TLVLimits(t *testing.T) {
+	addrs := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	tlvs := []byte{0x01, 0x00, 0x02, 'h', '2', 0x02, 0x00, 0x03, 'f', 'o', 'o'}
+	header := v2Header(0x1, 0x11, append(addrs, tlvs...))
+
+	cases := []struct {
+		opts []Option
+		err  error
+	}{
+		{nil, nil},
+		{[]Option{WithMaxTLVCount(2), WithMaxTLVBytes(len(tlvs))}, nil},
+		{[]Option{WithMaxTLVCount(1)}, ErrTLVTooLarge},
+		{[]Option{WithMaxTLVBytes(len(tlvs) - 1)}, ErrTLVTooLarge},
+	}
+
+	for _, c := range cases {
+		conn := Wrap(&bufConn{r: bytes.NewReader(append(header, "ping"...))}, c.opts...)
+		_, err := conn.Read(make([]byte, 4))
+		if err != c.err {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestHeaderInRemoteAddr(t *testing.T) {
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	payload = append(payload, 0x02, 0x00, 0x03, 'f', 'o', 'o')
+	input := append(v2Header(0x1, 0x11, payload), "ping"...)
+
+	conn := Wrap(&bufConn{r: bytes.NewReader(input)}, WithHeaderInRemoteAddr())
+	addr, ok := conn.RemoteAddr().(*Addr)
+	if !ok {
+		t.Fatalf("bad: %#v", conn.RemoteAddr())
+	}
+	if addr.String() != "10.1.1.1:1000" || addr.Network() != "tcp" {
+		t.Fatalf("bad: %v", addr)
+	}
+	if tlvs := addr.TLVs(); len(tlvs) != 1 || string(tlvs[0].Value) != "foo" {
+		t.Fatalf("bad: %v", tlvs)
+	}
+}
+
+func TestParse_v2_OverrideFor(t *testing.T) {
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	for fam, override := range map[byte]bool{0x11: true, 0x12: false} {
+		client, server := net.Pipe()
+		conn := Wrap(server, WithOverrideFor(TCP4, TCP6))
+		go client.Write(append(v2Header(0x1, fam, payload), "ping"...))
+
+		if _, err := conn.Read(make([]byte, 4)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if h := conn.ProxyHeader(); h == nil || h.SrcAddr.String() != "10.1.1.1:1000" {
+			t.Fatalf("bad: %v", h)
+		}
+		overridden := conn.RemoteAddr().String() == "10.1.1.1:1000"
+		if overridden != override {
+			t.Fatalf("bad: %#x %v", fam, conn.RemoteAddr())
+		}
+		client.Close()
+	}
+}
+
+func TestNetNS(t *testing.T) {
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	payload = append(payload, TLVTypeNetNS, 0x00, 0x06, 't', 'e', 'n', 'a', 'n', 't')
+
+	conn := Wrap(&bufConn{r: bytes.NewReader(v2Header(0x1, 0x11, payload))})
+	if ns, ok := conn.NetNS(); !ok || ns != "tenant" {
+		t.Fatalf("bad: %q %v", ns, ok)
+	}
+
+	conn = Wrap(&bufConn{r: bytes.NewReader(v2Header(0x1, 0x11, payload[:12]))})
+	if ns, ok := conn.NetNS(); ok {
+		t.Fatalf("bad: %q", ns)
+	}
+}
+
+func TestALPN(t *testing.T) {
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	payload = append(payload, TLVTypeALPN, 0x00, 0x02, 'h', '2')
+
+	conn := Wrap(&bufConn{r: bytes.NewReader(v2Header(0x1, 0x11, payload))})
+	if proto, ok := conn.ALPN(); !ok || proto != "h2" {
+		t.Fatalf("bad: %q %v", proto, ok)
+	}
+}
+
+func TestAuthority(t *testing.T) {
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	payload = append(payload, TLVTypeAuthority, 0x00, 0x0b)
+	payload = append(payload, "example.com"...)
+
+	conn := Wrap(&bufConn{r: bytes.NewReader(v2Header(0x1, 0x11, payload))})
+	if host, ok := conn.Authority(); !ok || host != "example.com" {
+		t.Fatalf("bad: %q %v", host, ok)
+	}
+}
+
+func TestParse_MaxHeaderBytes(t *testing.T) {
+	addrs := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	tlvs := []byte{0x01, 0x00, 0x02, 'h', '2', 0x02, 0x00, 0x03, 'f', 'o', 'o'}
+	v2 := v2Header(0x1, 0x11, append(addrs, tlvs...))
+	v1 := []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n")
+
+	cases := []struct {
+		input []byte
+		opts  []Option
+		err   error
+	}{
+		{v2, []Option{WithMaxHeaderBytes(len(v2))}, nil},
+		{v2, []Option{WithMaxHeaderBytes(len(v2) - 1)}, ErrHeaderTooLarge},
+		{v1, []Option{WithMaxHeaderBytes(len(v1))}, nil},
+		{v1, []Option{WithMaxHeaderBytes(len(v1) - 1)}, ErrHeaderTooLarge},
+		{append(v1, v2...), []Option{WithMaxChainedHeaders(2), WithMaxHeaderBytes(len(v1) + len(v2))}, nil},
+		{append(v1, v2...), []Option{WithMaxChainedHeaders(2), WithMaxHeaderBytes(len(v1) + 20)}, ErrHeaderTooLarge},
+	}
+
+	for i, c := range cases {
+		conn := Wrap(&bufConn{r: bytes.NewReader(append(c.input, "ping"...))}, c.opts...)
+		if _, err := conn.Read(make([]byte, 4)); err != c.err {
+			t.Fatalf("%d: err: %v", i, err)
+		}
+	}
+}
+
+func TestParse_v2_TimeoutCoversTLVs(t *testing.T) {
+	payload := []byte{10, 1, 1, 1, 20, 2, 2, 2, 0x03, 0xe8, 0x07, 0xd0}
+	payload = append(payload, 0x02, 0x00, 0x08)
+	payload = append(payload, "trickled"...)
+	header := v2Header(0x1, 0x11, payload)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := Wrap(server, WithProxyHeaderTimeout(100*time.Millisecond))
+
+	// Every byte arrives well within the timeout, but not the header
+	go func() {
+		client.Write(header[:v2HeaderLen])
+		for _, b := range header[v2HeaderLen:] {
+			time.Sleep(10 * time.Millisecond)
+			if _, err := client.Write([]byte{b}); err != nil {
+				return
+			}
+		}
+	}()
+
+	_, err := conn.Read(make([]byte, 1))
+	var timeoutErr *HeaderTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package proxyproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// ErrInvalidSignature is returned by the verifier of HMACVerifier when
+// a header is not correctly signed.
+var ErrInvalidSignature = errors.New("PROXY header signature missing or invalid")
+
+// HeaderVerifier checks a parsed header before it is trusted. If it
+// returns an error, the connection is closed and the error is returned
+// from Read.
+type HeaderVerifier func(*Header) error
+
+// HMACVerifier returns a HeaderVerifier requiring the header to carry a
+// TLV of type tlvType holding an HMAC-SHA256, keyed with key, over its
+// address fields, as added by SignHeader. Headers without addresses,
+// such as LOCAL or UNKNOWN ones, are accepted since the connection's
+// own addresses are used for them.
+func HMACVerifier(tlvType byte, key []byte) HeaderVerifier {
+	return func(h *Header) error {
+		if h.SrcAddr == nil {
+			return nil
+		}
+		expected, err := headerMAC(h, key)
+		if err != nil {
+			return err
+		}
+		for _, tlv := range h.TLVs {
+			if tlv.Type == tlvType && hmac.Equal(tlv.Value, expected) {
+				return nil
+			}
+		}
+		return ErrInvalidSignature
+	}
+}
+
+// SignHeader appends a TLV of type tlvType to h holding an HMAC-SHA256,
+// keyed with key, over the address fields of h, for verification with
+// HMACVerifier. The header must be written as version 2 to carry it.
+func SignHeader(h *Header, tlvType byte, key []byte) error {
+	mac, err := headerMAC(h, key)
+	if err != nil {
+		return err
+	}
+	h.TLVs = append(h.TLVs, TLV{Type: tlvType, Value: mac})
+	return nil
+}
+
+// headerMAC computes the HMAC over the address fields of h, which are
+// the family byte and address block of its version 2 encoding.
+func headerMAC(h *Header, key []byte) ([]byte, error) {
+	addrOnly := &Header{Version: 2, Command: "PROXY", Protocol: h.Protocol, SrcAddr: h.SrcAddr, DstAddr: h.DstAddr}
+	buf, err := addrOnly.Format()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf[13:14])
+	mac.Write(buf[v2HeaderLen:])
+	return mac.Sum(nil), nil
+}
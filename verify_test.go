@@ -0,0 +1,48 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestHMACVerifier(t *testing.T) {
+	key := []byte("secret")
+	const tlvType = 0xE0
+
+	src := netip.MustParseAddrPort("10.1.1.1:1000")
+	dst := netip.MustParseAddrPort("20.2.2.2:2000")
+
+	signed := NewHeaderV2(src, dst)
+	if err := SignHeader(signed, tlvType, key); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	wrongKey := NewHeaderV2(src, dst)
+	SignHeader(wrongKey, tlvType, []byte("other"))
+
+	// A signature copied onto another address must not verify
+	spoofed := NewHeaderV2(netip.MustParseAddrPort("6.6.6.6:1000"), dst)
+	spoofed.TLVs = signed.TLVs
+
+	cases := []struct {
+		h   *Header
+		err error
+	}{
+		{signed, nil},
+		{NewHeaderV2(src, dst), ErrInvalidSignature},
+		{wrongKey, ErrInvalidSignature},
+		{spoofed, ErrInvalidSignature},
+	}
+
+	for _, c := range cases {
+		buf, err := c.h.Format()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn := Wrap(&bufConn{r: bytes.NewReader(append(buf, "ping"...))},
+			WithHeaderVerifier(HMACVerifier(tlvType, key)))
+		if _, err := conn.Read(make([]byte, 4)); err != c.err {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}